@@ -0,0 +1,91 @@
+package ipc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const listenFdsStart = 3 // the first file descriptor passed by systemd, see sd_listen_fds(3)
+
+// adopted - the file descriptors passed by systemd that servers have already taken
+var adopted = struct {
+	sync.Mutex
+	fds map[int]bool
+}{fds: map[int]bool{}}
+
+// activationListener - adopts the unix socket systemd passed to the process for the server called name.
+// The socket is picked by its FileDescriptorName=, or if only one socket was passed it's used whatever it's called.
+// The file descriptor is closed once it has been adopted, so it can only be used by one server.
+// Once every socket passed has been adopted LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES are unset, so child processes don't see them.
+func activationListener(name string) (net.Listener, error) {
+
+	adopted.Lock()
+	defer adopted.Unlock()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("no sockets were passed by systemd, LISTEN_PID isn't this process")
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, errors.New("no sockets were passed by systemd, LISTEN_FDS isn't set")
+	}
+
+	fd := -1
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < n && i < len(names); i++ {
+		if names[i] == name {
+			fd = listenFdsStart + i
+			break
+		}
+	}
+
+	if fd == -1 {
+		if n > 1 {
+			return nil, fmt.Errorf("none of the sockets passed by systemd are named %q, set FileDescriptorName= in the socket unit", name)
+		}
+		fd = listenFdsStart
+	}
+
+	if adopted.fds[fd] {
+		return nil, fmt.Errorf("the socket passed by systemd for %q is already in use", name)
+	}
+
+	syscall.CloseOnExec(fd)
+
+	f := os.NewFile(uintptr(fd), name)
+	listen, err := net.FileListener(f)
+	f.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := listen.(*net.UnixListener); !ok {
+		listen.Close()
+		return nil, errors.New("the socket passed by systemd isn't a unix socket")
+	}
+
+	adopted.fds[fd] = true
+
+	if len(adopted.fds) == n {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}
+
+	return listen, nil
+}
+
+func socketActivationSupported() bool {
+
+	return true
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package ipc
+
+import (
+	"errors"
+	"net"
+)
+
+// activationListener - never called, WithSocketActivation() is refused on other platforms
+func activationListener(name string) (net.Listener, error) {
+
+	return nil, errors.New("socket activation is only supported on linux")
+}
+
+func socketActivationSupported() bool {
+
+	return false
+}
@@ -0,0 +1,49 @@
+package ipc
+
+import "sync"
+
+// maxPooledBuffer - buffers bigger than this aren't returned to the pool, so one large message doesn't pin the memory
+const maxPooledBuffer = 1 << 20
+
+var buffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 4096)
+		return &b
+	},
+}
+
+// getBuffer - takes a buffer of length size from the pool
+func getBuffer(size int) *[]byte {
+
+	b := buffers.Get().(*[]byte)
+
+	if cap(*b) < size {
+		*b = make([]byte, size)
+	}
+	*b = (*b)[:size]
+
+	return b
+}
+
+// putBuffer - returns a buffer to the pool, it mustn't be used afterwards
+func putBuffer(b *[]byte) {
+
+	if b == nil || cap(*b) > maxPooledBuffer {
+		return
+	}
+
+	*b = (*b)[:0]
+	buffers.Put(b)
+}
+
+// Release - returns the buffer holding m.Data so it can be reused for another message.
+// Optional, but it saves an allocation for every message read. m.Data mustn't be used after calling it.
+func (m *Message) Release() {
+
+	if m.buf != nil {
+		putBuffer(m.buf)
+		m.buf = nil
+	}
+
+	m.Data = nil
+}
@@ -1,18 +1,81 @@
 package ipc
 
 import (
-	"bufio"
+	"context"
 	"errors"
-	"io"
 	"log"
+	"os"
 	"strings"
-	"time"
+
+	"github.com/james-barrow/golang-ipc/wire"
 )
 
 // StartClient - start the ipc client.
 // ipcName = is the name of the unix socket or named pipe that the client will try and connect to.
+// config - can be nil for the defaults, NewClient() is the same but takes options instead.
 func StartClient(ipcName string, config *ClientConfig) (*Client, error) {
 
+	o := config.options()
+
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+
+	return newClient(ipcName, o)
+}
+
+// NewClient - starts the ipc client configured with opts, e.g. NewClient("name", WithTimeout(5*time.Second), WithSuppressStatus()).
+// An error is returned if an option is invalid or doesn't apply to a client.
+func NewClient(ipcName string, opts ...Option) (*Client, error) {
+
+	o := defaultOptions()
+
+	if err := o.apply(opts, false); err != nil {
+		return nil, err
+	}
+
+	return newClient(ipcName, o)
+}
+
+// StartServiceClient - the same as StartClient(), but connects to the most recently started server announced in the registry as
+// speaking protocol instead of one with an exact name, see ServerConfig.Service. The registry is only searched once, so if that server
+// goes away the client tries to reconnect to the same name.
+func StartServiceClient(protocol string, config *ClientConfig) (*Client, error) {
+
+	dir := registryDir
+	if config != nil && config.RegistryDir != "" {
+		dir = config.RegistryDir
+	}
+
+	name, err := findServer(dir, protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	return StartClient(name, config)
+}
+
+// NewServiceClient - the same as NewClient(), but connects to the most recently started server announced in the registry as
+// speaking protocol instead of one with an exact name, see WithService(). The registry is only searched once, so if that server
+// goes away the client tries to reconnect to the same name.
+func NewServiceClient(protocol string, opts ...Option) (*Client, error) {
+
+	o := defaultOptions()
+
+	if err := o.apply(opts, false); err != nil {
+		return nil, err
+	}
+
+	name, err := findServer(o.registryDir, protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	return newClient(name, o)
+}
+
+func newClient(ipcName string, o *options) (*Client, error) {
+
 	err := checkIpcName(ipcName)
 	if err != nil {
 		return nil, err
@@ -20,39 +83,52 @@ func StartClient(ipcName string, config *ClientConfig) (*Client, error) {
 	}
 
 	cc := &Client{
-		Name:     ipcName,
-		status:   NotConnected,
-		received: make(chan *Message),
-		toWrite:  make(chan *Message),
+		Name:            ipcName,
+		status:          NotConnected,
+		timeout:         o.timeout,
+		reconnectPolicy: o.reconnect,
+		noReconnect:     o.noReconnect,
+		id:              o.clientID,
+		transport:       o.transport,
+		clock:           o.clock,
+		received:        make(chan *Message),
+		toWrite:         make(chan *Message, o.writeBuffer),
+		toWriteHigh:     make(chan *Message, o.writeBuffer),
+		toWriteLow:      make(chan *Message, o.writeBuffer),
+		encryptionReq:   o.encryption,
+		events:          make(chan Event, eventBuffer),
+		closing:         make(chan struct{}),
+		closed:          make(chan struct{}),
+		noStatus:        o.noStatus,
+		stats:           newStats(),
+		tracer:          o.tracer,
+		writePolicy:     o.writePolicy,
+		maxBatch:        o.maxBatch,
+		batchLatency:    o.batchLatency,
+		shm:             o.shm,
+		onExpired:       o.onExpired,
+		recorder:        o.recorder,
 	}
 
-	if config == nil {
+	cc.metrics = newMetrics(cc.stats, o.metrics)
 
-		cc.timeout = 0
-		cc.retryTimer = time.Duration(20)
-		cc.encryptionReq = true
-
-	} else {
+	if cc.tracer == nil {
+		cc.tracer = contextTracer{}
+	}
 
-		if config.Timeout < 0 {
-			cc.timeout = 0
-		} else {
-			cc.timeout = config.Timeout
-		}
+	if cc.reconnectPolicy == nil {
+		cc.reconnectPolicy = ConstantBackoff{Delay: o.retryTimer}
+	}
 
-		if config.RetryTimer < 1 {
-			cc.retryTimer = time.Duration(1)
-		} else {
-			cc.retryTimer = time.Duration(config.RetryTimer)
-		}
+	if cc.clock == nil {
+		cc.clock = realClock{}
+	}
 
-		if !config.Encryption {
-			cc.encryptionReq = false
-		} else {
-			cc.encryptionReq = true // defualt is to always enforce encryption
-		}
+	if cc.id == "" {
+		cc.id = newClientID()
 	}
 
+	cc.wg.Add(1)
 	go startClient(cc)
 
 	return cc, nil
@@ -60,120 +136,268 @@ func StartClient(ipcName string, config *ClientConfig) (*Client, error) {
 
 func startClient(c *Client) {
 
-	c.status = Connecting
-	c.received <- &Message{Status: c.status.String(), MsgType: -1}
+	defer c.wg.Done()
+
+	c.statusChange(Connecting)
 
 	err := c.dial()
 	if err != nil {
-		c.received <- &Message{Err: err, MsgType: -1}
+		if c.getStatus() == Closing {
+			c.closeRead(errors.New("client has closed the connection"))
+			return
+		}
+
+		if err.Error() == "timed out trying to connect" || err.Error() == "gave up trying to connect" {
+			c.setStatus(Closed)
+		} else {
+			c.setStatus(Error)
+		}
+
+		c.reportError(err, -1)
 		return
 	}
 
-	c.status = Connected
-	c.received <- &Message{Status: c.status.String(), MsgType: -1}
+	if c.connected() {
+		c.notify(Connected)
+	}
+}
+
+// connected - moves the status to Connected and starts the read & write goroutines for the new connection.
+// Returns false if the client was closed while it was connecting.
+func (c *Client) connected() bool {
+
+	// older servers ignore control messages, so headers can always be sent
+	sess := &session{conn: newFileConn(c.conn, c.encryption), peerCaps: capHeaders, done: make(chan struct{})}
+	if c.encryption {
+		sess.cipher = *c.enc.cipher
+	}
+
+	// if this fails the read goroutine finds out the connection has gone
+	hello(sess, c.id)
+
+	c.setPeer(newPeer(c.conn, c.encryption, c.maxMsgSize))
+
+	if !c.setStatus(Connected) {
+		c.conn.Close()
+		return false
+	}
+
+	c.wg.Add(2)
+	go c.read(sess)
+	go c.write(sess)
 
-	go c.read()
-	go c.write()
+	return true
 }
 
-func (c *Client) read() {
-	bLen := make([]byte, 4)
+// read - reads messages until the connection ends, then closes sess.done to stop the write goroutine
+func (c *Client) read(sess *session) {
+
+	defer c.wg.Done()
+	defer close(sess.done)
+
+	var headers map[string]string
+	var files []*os.File
+	var buf *[]byte
+
+	c.mutex.Lock()
+	maxMsgSize := c.maxMsgSize
+	c.mutex.Unlock()
+
+	dec := wire.NewDecoder(sess.conn, sess.cipher, maxMsgSize)
+	dec.Alloc = func(n int) []byte {
+		buf = getBuffer(n)
+		return *buf
+	}
 
 	for {
 
-		res := c.readData(bLen)
-		if !res {
-			break
-		}
+		buf = nil
+
+		f, err := dec.Decode()
+		if err != nil {
+			putBuffer(buf)
 
-		mLen := bytesToInt(bLen)
+			var decryptErr *wire.DecryptError
 
-		msgRecvd := make([]byte, mLen)
+			switch {
+			case errors.As(err, &decryptErr):
+				// the frame has been read in full, so skip it and carry on with the next one
+				c.metrics.DecryptionError()
+				log.Println("error decrypting message", err)
+				continue
+			case err == wire.ErrFrameTooLong || err == wire.ErrFrameTooShort:
+				// the rest of the stream can't be trusted, the next read fails and ends the connection
+				log.Println(err)
+				sess.conn.Close()
+				continue
+			default:
+				c.readFailed(sess, err)
+			}
 
-		res = c.readData(msgRecvd)
-		if !res {
 			break
 		}
 
-		if c.encryption {
-			msgFinal, err := decrypt(*c.enc.cipher, msgRecvd)
-			if err != nil {
-				break
+		msgType, data := f.MsgType, f.Data
+
+		if msgType == 0 {
+			//  type 0 = control message
+			code, h := control(data)
+
+			switch code {
+			case ctrlHeaders:
+				headers = h
+			case ctrlFiles:
+				files = sess.takeFiles(data[1:])
+			case ctrlCaps:
+				if len(data) > 1 {
+					sess.setCaps(capHeaders | data[1])
+				}
+			case ctrlChunk:
+				t, msg, err := sess.addChunk(data[1:], maxMsgSize)
+				if err != nil {
+					log.Println(err)
+				}
+				if msg != nil {
+					// the last chunk, the message is delivered below
+					putBuffer(buf)
+					buf = nil
+					msgType, data = t, msg
+				}
 			}
 
-			if bytesToInt(msgFinal[:4]) == 0 {
-				//  type 0 = control message
-			} else {
-				c.received <- &Message{Data: msgFinal[4:], MsgType: bytesToInt(msgFinal[:4])}
-			}
+			if msgType == 0 {
+				putBuffer(buf)
 
-		} else {
+				if code == ctrlGoodbye {
+					// the server has shut down, don't try to reconnect
+					sess.conn.Close()
+					c.setPeer(nil)
+					c.statusChange(Disconnected)
+					break
+				}
 
-			if bytesToInt(msgRecvd[:4]) == 0 {
-				//  type 0 = control message
-			} else {
-				c.received <- &Message{Data: msgRecvd[4:], MsgType: bytesToInt(msgRecvd[:4])}
+				continue
 			}
 		}
-	}
-}
 
-func (c *Client) readData(buff []byte) bool {
-
-	_, err := io.ReadFull(c.conn, buff)
-	if err != nil {
-		if strings.Contains(err.Error(), "EOF") { // the connection has been closed by the client.
-			c.conn.Close()
-
-			if c.status != Closing || c.status == Closed {
-				go c.reconnect()
+		c.metrics.MessageReceived(msgType, len(data))
+		m := newMessage(c.tracer, msgType, data, headers)
+		m.buf = buf
+		m.Files = files
+		headers = nil
+		files = nil
+
+		if m.expired(c.clock.Now()) {
+			c.metrics.MessageExpired(msgType)
+			if c.onExpired != nil {
+				c.onExpired(m)
 			}
-			return false
+			closeFiles(m.Files)
+			m.Release()
+			continue
 		}
 
-		if c.status == Closing {
-			c.status = Closed
-			c.received <- &Message{Status: c.status.String(), MsgType: -1}
-			c.received <- &Message{Err: errors.New("client has closed the connection"), MsgType: -2}
-			return false
+		if c.recorder != nil {
+			c.recorder.RecordReceived(m)
 		}
 
-		// other read error
-		return false
+		if !c.deliver(m) {
+			closeFiles(m.Files)
+			m.Release()
+		}
+	}
+}
 
+// readFailed - the connection couldn't be read from, either the client is closing or the connection has been lost
+func (c *Client) readFailed(sess *session, err error) {
+
+	eof := strings.Contains(err.Error(), "EOF") // the connection has been closed by the server.
+
+	if !eof && c.getStatus() == Closing {
+		c.closeRead(errors.New("client has closed the connection"))
+		return
 	}
 
-	return true
+	// any other error, e.g. the connection was reset, also means the connection has been lost
+	sess.conn.Close()
 
+	if c.getStatus() == Closing {
+		return
+	}
+
+	if c.noReconnect {
+		c.setPeer(nil)
+		c.statusChange(Disconnected)
+		return
+	}
+
+	c.wg.Add(1)
+	go c.reconnect()
 }
 
 func (c *Client) reconnect() {
 
-	c.status = ReConnecting
-	c.received <- &Message{Status: c.status.String(), MsgType: -1}
+	defer c.wg.Done()
+
+	c.setPeer(nil)
+
+	if !c.setStatus(ReConnecting) {
+		return // closed
+	}
+	c.notify(ReConnecting)
 
 	err := c.dial() // connect to the pipe
 	if err != nil {
-		if err.Error() == "timed out trying to connect" {
-			c.status = Timeout
-			c.received <- &Message{Status: c.status.String(), MsgType: -1}
-			c.received <- &Message{Err: errors.New("timed out trying to re-connect"), MsgType: -1}
+		switch {
+		case c.getStatus() == Closing:
+			c.closeRead(errors.New("client has closed the connection"))
+		case err.Error() == "timed out trying to connect":
+			c.statusChange(Timeout)
+			c.reportError(errors.New("timed out trying to re-connect"), -1)
+		case err.Error() == "gave up trying to connect":
+			c.statusChange(Timeout)
+			c.reportError(errors.New("gave up trying to re-connect"), -1)
+		default:
+			c.statusChange(Error)
+			c.reportError(err, -1)
 		}
 
 		return
 	}
 
-	c.status = Connected
-	c.received <- &Message{Status: c.status.String(), MsgType: -1}
+	if c.connected() {
+		c.notify(Connected)
+	}
+}
 
-	go c.read()
+// readClosed - what Read() returns once the connection has been closed, see closeRead()
+func (c *Client) readClosed() (*Message, error) {
+
+	c.mutex.Lock()
+	notify := c.closeStatus
+	c.closeStatus = false
+	c.mutex.Unlock()
+
+	if notify {
+		return &Message{Status: "Closed", MsgType: -1}, nil
+	}
+
+	return nil, c.closeErr
 }
 
 // Read - blocking function that receices messages
-// if MsgType is a negative number its an internal message
+// if MsgType is a negative number its an internal message, these can be turned off with ClientConfig.SuppressStatus
 func (c *Client) Read() (*Message, error) {
 
-	m, ok := (<-c.received)
+	var m *Message
+	var ok bool
+
+	select {
+	case m, ok = <-c.received:
+	case <-c.closed:
+		return c.readClosed()
+	}
+
 	if !ok {
 		return nil, errors.New("the received channel has been closed")
 	}
@@ -181,6 +405,8 @@ func (c *Client) Read() (*Message, error) {
 	if m.Err != nil {
 		close(c.received)
 		close(c.toWrite)
+		close(c.toWriteHigh)
+		close(c.toWriteLow)
 		return nil, m.Err
 	}
 
@@ -189,89 +415,181 @@ func (c *Client) Read() (*Message, error) {
 
 // Write - writes a  message to the ipc connection.
 // msgType - denotes the type of data being sent. 0 is a reserved type for internal messages and errors.
-func (c *Client) Write(msgType int, message []byte) error {
+// opts - e.g. WithTTL(), a message that hasn't been written before its deadline is dropped.
+func (c *Client) Write(msgType int, message []byte, opts ...WriteOption) error {
 
-	if msgType == 0 {
-		return errors.New("Message type 0 is reserved")
-	}
+	return c.queue(newWrite(c.clock.Now(), msgType, message, opts), c.writePolicy)
+}
 
-	if c.status != Connected {
-		return errors.New(c.status.String())
-	}
+// TryWrite - the same as Write() but never blocks, ErrQueueFull is returned if the outbound buffer is full
+func (c *Client) TryWrite(msgType int, message []byte, opts ...WriteOption) error {
 
-	mlen := len(message)
-	if mlen > c.maxMsgSize {
-		return errors.New("Message exceeds maximum message length")
+	return c.queue(newWrite(c.clock.Now(), msgType, message, opts), WriteFailFast)
+}
+
+// WritePriority - writes a message with the given priority, queued messages with a higher priority are written first
+func (c *Client) WritePriority(priority Priority, msgType int, message []byte) error {
+
+	return c.queue(&Message{MsgType: msgType, Data: message, Priority: priority}, c.writePolicy)
+}
+
+// WriteContext - writes a message to the ipc connection along with the trace context held in ctx.
+// The trace context is taken from ctx by ClientConfig.Tracer, or ContextWithTrace() if no tracer is set.
+func (c *Client) WriteContext(ctx context.Context, msgType int, message []byte) error {
+
+	headers, err := traceHeaders(c.tracer, ctx, nil)
+	if err != nil {
+		return err
 	}
 
-	c.toWrite <- &Message{MsgType: msgType, Data: message}
+	return c.queue(&Message{MsgType: msgType, Data: message, Headers: headers}, c.writePolicy)
+}
 
-	return nil
+// WriteMessage - writes m.MsgType, m.Data and m.Headers to the ipc connection.
+// The headers are dropped if the other end of the connection doesn't support them.
+func (c *Client) WriteMessage(m *Message) error {
+
+	if err := wire.ValidHeaders(m.Headers); err != nil {
+		return err
+	}
+
+	return c.queue(&Message{MsgType: m.MsgType, Data: m.Data, Headers: m.Headers, Priority: m.Priority, Deadline: m.Deadline}, c.writePolicy)
 }
 
-func (c *Client) write() {
+// WriteBatch - writes the messages in order, they are written together without any other message in between.
+// Either all of the messages are queued or, if any of them can't be sent, none are. The batch has the priority of the first message.
+func (c *Client) WriteBatch(messages []Message) error {
 
-	for {
+	if len(messages) == 0 {
+		return nil
+	}
 
-		m, ok := <-c.toWrite
+	batch := make([]*Message, len(messages))
 
-		if !ok {
-			break
+	for i, m := range messages {
+		if err := wire.ValidHeaders(m.Headers); err != nil {
+			return err
 		}
 
-		toSend := intToBytes(m.MsgType)
-
-		writer := bufio.NewWriter(c.conn)
+		batch[i] = &Message{MsgType: m.MsgType, Data: m.Data, Headers: m.Headers, Deadline: m.Deadline}
+	}
 
-		if c.encryption {
-			toSend = append(toSend, m.Data...)
-			toSendEnc, err := encrypt(*c.enc.cipher, toSend)
-			if err != nil {
-				log.Println("error encrypting data", err)
-				continue
-			}
-			toSend = toSendEnc
-		} else {
+	return c.queue(&Message{batch: batch, Priority: messages[0].Priority}, c.writePolicy)
+}
 
-			toSend = append(toSend, m.Data...)
+// queue - checks the message can be sent and passes it to the write goroutine
+func (c *Client) queue(m *Message, policy WritePolicy) error {
 
+	for _, mm := range m.messages() {
+		if mm.MsgType == 0 {
+			return errors.New("Message type 0 is reserved")
 		}
+	}
 
-		writer.Write(intToBytes(len(toSend)))
-		writer.Write(toSend)
+	c.mutex.Lock()
+	status := c.status
+	max := c.maxMsgSize
+	c.mutex.Unlock()
 
-		err := writer.Flush()
-		if err != nil {
-			log.Println("error flushing data", err)
-			continue
+	if status != Connected {
+		return errors.New(status.String())
+	}
+
+	for _, mm := range m.messages() {
+		mlen := len(mm.Data)
+		if mlen > max {
+			return errors.New("Message exceeds maximum message length")
 		}
+	}
+
+	return enqueue(c.queueFor(m.Priority), m, policy, c.metrics)
+}
 
+// queueFor - the outbound queue for messages of the priority
+func (c *Client) queueFor(p Priority) chan *Message {
+
+	switch p.lane() {
+	case 0:
+		return c.toWriteHigh
+	case 2:
+		return c.toWriteLow
 	}
+
+	return c.toWrite
 }
 
-// getStatus - get the current status of the connection
-func (c *Client) getStatus() Status {
+// write - writes queued messages until the session ends or a goodbye has been sent
+func (c *Client) write(sess *session) {
 
-	return c.status
+	defer c.wg.Done()
+
+	writeLoop(sess, newLanes(c.toWriteHigh, c.toWrite, c.toWriteLow, c.metrics, c.clock), c.maxBatch, c.batchLatency, c.metrics, c.recorder)
 }
 
 // StatusCode - returns the current connection status
 func (c *Client) StatusCode() Status {
-	return c.status
+	return c.getStatus()
 }
 
 // Status - returns the current connection status as a string
 func (c *Client) Status() string {
 
-	return c.status.String()
+	status := c.getStatus()
+
+	return status.String()
 }
 
 // Close - closes the connection
 func (c *Client) Close() {
 
-	c.status = Closing
+	c.setStatus(Closing)
 
-	if c.conn != nil {
-		c.conn.Close()
+	c.mutex.Lock()
+	conn := c.conn
+	c.mutex.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+
+	// there's no goroutine left to do this once the client has disconnected, timed out or failed
+	c.closeRead(errors.New("client has closed the connection"))
+}
+
+// Shutdown - gracefully closes the client.
+// Write() is stopped, messages already queued are sent followed by a goodbye so the server sees an orderly disconnect,
+// then the connection is closed. Read() returns an error once the connection has closed. Shutdown waits for the client's
+// goroutines to exit, if ctx ends first the connection is closed straight away and ctx.Err() is returned.
+func (c *Client) Shutdown(ctx context.Context) error {
+
+	connected := c.getStatus() == Connected
+
+	c.setStatus(Closing)
+
+	finished := make(chan struct{})
+
+	go func() {
+
+		c.wg.Wait()
+		close(finished)
+	}()
+
+	if connected {
+		select {
+		case c.toWriteLow <- goodbye(): // the lowest priority, so it's written after everything else
+		case <-finished: // the connection was lost first, there's no write goroutine to send it
+		case <-ctx.Done():
+		}
 	}
+
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		c.Close()
+		return ctx.Err()
+	}
+
+	c.closeRead(errors.New("client has closed the connection")) // if it hasn't already been closed by the read goroutine
+
+	return nil
 }
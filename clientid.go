@@ -0,0 +1,67 @@
+package ipc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+
+	"github.com/james-barrow/golang-ipc/wire"
+)
+
+// newClientID - the ID used when the client isn't given one, it stays the same when the client reconnects
+func newClientID() string {
+
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(b)
+}
+
+func validClientID(id string) error {
+
+	if id == "" || len(id) > wire.MaxClientID {
+		return errors.New("client ID must be between 1 and 256 bytes")
+	}
+
+	return nil
+}
+
+// hello - the control message carrying the client's ID, written before anything else once the handshake has finished.
+// Older servers ignore it, newer servers know to expect it from the capClientID capability.
+func hello(sess *session, id string) error {
+
+	return wire.NewEncoder(sess.conn, sess.cipher).Encode(wire.Frame{MsgType: 0, Data: append([]byte{ctrlHello}, id...)})
+}
+
+// readHello - reads the client's ID, the first message sent by clients with capClientID
+func (s *Server) readHello(sess *session) (string, error) {
+
+	f, err := wire.NewDecoder(sess.conn, sess.cipher, 1+wire.MaxClientID).Decode()
+	if err != nil {
+		var decryptErr *wire.DecryptError
+		if errors.As(err, &decryptErr) || err == wire.ErrFrameTooLong || err == wire.ErrFrameTooShort {
+			return "", errors.New("invalid client ID")
+		}
+		return "", errors.New("failed to receive client ID")
+	}
+
+	if f.MsgType != 0 || len(f.Data) == 0 || f.Data[0] != ctrlHello {
+		return "", errors.New("invalid client ID")
+	}
+
+	id := string(f.Data[1:])
+	if err := validClientID(id); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// ClientID - the ID the client sends to the server each time it connects
+func (c *Client) ClientID() string {
+
+	return c.id
+}
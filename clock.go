@@ -0,0 +1,21 @@
+package ipc
+
+import "time"
+
+// Clock - the time used by the client to time out, wait between attempts to connect and check message deadlines.
+// Tests can replace it with a fake clock, e.g. from the ipctest package, using WithClock().
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock - the default Clock
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
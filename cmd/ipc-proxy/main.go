@@ -0,0 +1,96 @@
+// Command ipc-proxy sits between an ipc client and server and logs every message they send each other, decrypted.
+//
+//	ipc-proxy [flags] <listen name> <server name>
+//
+// Point the client at the listen name instead of the server's name. Messages can also be delayed or dropped to see how
+// the client and server cope, e.g. ipc-proxy --delay 200ms --jitter 100ms --drop 0.1 debug example
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"time"
+
+	ipc "github.com/james-barrow/golang-ipc"
+	"github.com/james-barrow/golang-ipc/proxy"
+)
+
+func main() {
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := run(ctx, os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintln(os.Stderr, "ipc-proxy:", err)
+		}
+		os.Exit(2)
+	}
+}
+
+// run - runs the proxy until ctx is cancelled
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+
+	fs := flag.NewFlagSet("ipc-proxy", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, "usage: ipc-proxy [flags] <listen name> <server name>\n\nflags:\n")
+		fs.PrintDefaults()
+	}
+
+	var config proxy.Config
+
+	logFile := fs.String("log", "", "write the log to this file instead of stdout")
+	fs.DurationVar(&config.Delay, "delay", 0, "hold each message this long before sending it on")
+	fs.DurationVar(&config.Jitter, "jitter", 0, "add up to this much to the delay at random")
+	fs.Float64Var(&config.DropRate, "drop", 0, "fraction of messages, 0 to 1, to drop")
+	encryption := fs.Bool("encryption", true, "encrypt the connection with the client")
+	upstreamEncryption := fs.Bool("upstream-encryption", true, "refuse to connect unless the server uses encryption")
+	maxMsgSize := fs.Int("max-msg-size", 3145728, "largest message in bytes the client can send, at least 1024")
+	unmask := fs.Bool("unmask", false, "let any user connect to the listen socket")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("expected the listen name and the server name")
+	}
+
+	config.Log = stdout
+	if *logFile != "" {
+		f, err := os.OpenFile(*logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		config.Log = f
+	}
+
+	config.ServerOptions = []ipc.Option{ipc.WithEncryption(*encryption), ipc.WithMaxMsgSize(*maxMsgSize)}
+	if *unmask {
+		config.ServerOptions = append(config.ServerOptions, ipc.WithUnmaskPermissions())
+	}
+
+	// keep trying the server every few seconds at most, so it can be restarted while debugging
+	config.ClientOptions = []ipc.Option{
+		ipc.WithEncryption(*upstreamEncryption),
+		ipc.WithReconnectPolicy(ipc.ExponentialBackoff{Max: 2 * time.Second}),
+	}
+
+	p, err := proxy.Start(fs.Arg(0), fs.Arg(1), &config)
+	if err != nil {
+		return err
+	}
+
+	<-ctx.Done()
+	p.Close()
+
+	return nil
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	ipc "github.com/james-barrow/golang-ipc"
+)
+
+// clientFlags - the flags of the commands that connect as a client
+type clientFlags struct {
+	timeout    time.Duration
+	encryption bool
+	id         string
+}
+
+func (f *clientFlags) register(fs *flag.FlagSet) {
+
+	fs.DurationVar(&f.timeout, "timeout", 5*time.Second, "how long to keep trying to connect, 0 is forever")
+	fs.BoolVar(&f.encryption, "encryption", true, "refuse to connect unless the server uses encryption")
+	fs.StringVar(&f.id, "id", "", "client ID sent to the server (default is a random ID)")
+}
+
+// serverFlags - the flags of the commands that run a server
+type serverFlags struct {
+	encryption bool
+	maxMsgSize int
+	unmask     bool
+}
+
+func (f *serverFlags) register(fs *flag.FlagSet) {
+
+	fs.BoolVar(&f.encryption, "encryption", true, "encrypt the connection")
+	fs.IntVar(&f.maxMsgSize, "max-msg-size", 3145728, "largest message in bytes, at least 1024")
+	fs.BoolVar(&f.unmask, "unmask", false, "let any user connect to the socket")
+}
+
+// dial - connects to the server and returns the details agreed during the handshake
+func (cmd *command) dial(ctx context.Context, name string, f *clientFlags) (*ipc.Client, *ipc.Peer, error) {
+
+	opts := []ipc.Option{
+		ipc.WithEncryption(f.encryption),
+		ipc.WithSuppressStatus(),
+		ipc.WithoutReconnect(),
+		ipc.WithReconnectPolicy(ipc.ExponentialBackoff{Initial: 50 * time.Millisecond, Max: time.Second}),
+	}
+
+	if f.timeout > 0 {
+		opts = append(opts, ipc.WithTimeout(f.timeout))
+	}
+
+	if f.id != "" {
+		opts = append(opts, ipc.WithClientID(f.id))
+	}
+
+	c, err := ipc.NewClient(name, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for {
+		select {
+		case e := <-c.Events():
+			if e.Err != nil && e.Attempt == 0 {
+				c.Close()
+				return nil, nil, e.Err
+			}
+			if e.Status == ipc.Connected && e.Peer != nil {
+				return c, e.Peer, nil
+			}
+		case <-ctx.Done():
+			c.Close()
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+// listenServer - starts the server, statuses are read from Events() instead of Read()
+func (cmd *command) listenServer(name string, f *serverFlags) (*ipc.Server, error) {
+
+	opts := []ipc.Option{ipc.WithEncryption(f.encryption), ipc.WithMaxMsgSize(f.maxMsgSize), ipc.WithSuppressStatus()}
+
+	if f.unmask {
+		opts = append(opts, ipc.WithUnmaskPermissions())
+	}
+
+	return ipc.NewServer(name, opts...)
+}
+
+// received - a message, or the error returned by Read()
+type received struct {
+	m   *ipc.Message
+	err error
+}
+
+// readLoop - calls read until it fails or done is closed, the channel is closed when it stops
+func readLoop(read func() (*ipc.Message, error), stopOnError bool, done <-chan struct{}) <-chan received {
+
+	ch := make(chan received)
+
+	go func() {
+
+		defer close(ch)
+
+		for {
+			m, err := read()
+
+			select {
+			case ch <- received{m: m, err: err}:
+			case <-done:
+				return
+			}
+
+			if err != nil && stopOnError {
+				return
+			}
+		}
+	}()
+
+	return ch
+}
+
+// shutdown - gives queued messages a few seconds to be written
+func shutdown(c interface{ Shutdown(context.Context) error }) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return c.Shutdown(ctx)
+}
+
+func (cmd *command) send(ctx context.Context, args []string) error {
+
+	var cf clientFlags
+	var headers headerFlag
+
+	fs := flag.NewFlagSet("send", flag.ContinueOnError)
+	cf.register(fs)
+	msgType := fs.Int("type", 1, "message type, greater than 0")
+	data := fs.String("data", "", "message data, @file to read it from a file or @- from stdin")
+	fs.Var(&headers, "header", "key=value header sent with the message, can be repeated")
+	wait := fs.Bool("wait", false, "wait for a reply and print it")
+	format := fs.String("format", "text", "how the reply is printed: text, hex or json")
+
+	name, err := cmd.parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if *msgType < 1 {
+		return errors.New("message type must be greater than 0")
+	}
+
+	p, err := newPrinter(*format, cmd.stdout)
+	if err != nil {
+		return err
+	}
+
+	b, err := readData(*data, cmd.stdin)
+	if err != nil {
+		return err
+	}
+
+	c, _, err := cmd.dial(ctx, name, &cf)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	msgs := readLoop(c.Read, true, done)
+
+	if err := c.WriteMessage(&ipc.Message{MsgType: *msgType, Data: b, Headers: headers.m}); err != nil {
+		c.Close()
+		return err
+	}
+
+	if *wait {
+	wait:
+		for {
+			select {
+			case r := <-msgs:
+				if r.err != nil {
+					return r.err
+				}
+				if r.m.MsgType > 0 {
+					if err := p.print(r.m); err != nil {
+						c.Close()
+						return err
+					}
+					break wait
+				}
+			case <-ctx.Done():
+				c.Close()
+				return ctx.Err()
+			}
+		}
+	}
+
+	return shutdown(c)
+}
+
+func (cmd *command) listen(ctx context.Context, args []string) error {
+
+	var cf clientFlags
+	var sf serverFlags
+
+	fs := flag.NewFlagSet("listen", flag.ContinueOnError)
+	server := fs.Bool("server", false, "start a server instead of connecting to one")
+	cf.register(fs)
+	fs.IntVar(&sf.maxMsgSize, "max-msg-size", 3145728, "largest message in bytes with --server, at least 1024")
+	fs.BoolVar(&sf.unmask, "unmask", false, "let any user connect to the socket with --server")
+	format := fs.String("format", "text", "how messages are printed: text, hex or json")
+	count := fs.Int("count", 0, "exit after this many messages, 0 is never")
+
+	name, err := cmd.parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	p, err := newPrinter(*format, cmd.stdout)
+	if err != nil {
+		return err
+	}
+
+	if *server {
+		sf.encryption = cf.encryption
+
+		s, err := cmd.listenServer(name, &sf)
+		if err != nil {
+			return err
+		}
+
+		return cmd.serve(ctx, s, *count, func(m *ipc.Message) error { return p.print(m) })
+	}
+
+	c, peer, err := cmd.dial(ctx, name, &cf)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cmd.stderr, "connected to %s\n", peer.Addr)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	msgs := readLoop(c.Read, true, done)
+
+	for n := 0; *count == 0 || n < *count; {
+		select {
+		case r := <-msgs:
+			if r.err != nil {
+				return r.err
+			}
+			if r.m.MsgType < 1 {
+				continue
+			}
+			if err := p.print(r.m); err != nil {
+				c.Close()
+				return err
+			}
+			n++
+		case e := <-c.Events():
+			if e.Status == ipc.Disconnected {
+				fmt.Fprintln(cmd.stderr, "disconnected")
+				return nil
+			}
+		case <-ctx.Done():
+			c.Close()
+			return nil
+		}
+	}
+
+	return shutdown(c)
+}
+
+func (cmd *command) echo(ctx context.Context, args []string) error {
+
+	var sf serverFlags
+
+	fs := flag.NewFlagSet("echo", flag.ContinueOnError)
+	sf.register(fs)
+	format := fs.String("format", "text", "how messages are printed: text, hex or json")
+	quiet := fs.Bool("quiet", false, "don't print the messages")
+	count := fs.Int("count", 0, "exit after echoing this many messages, 0 is never")
+
+	name, err := cmd.parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	p, err := newPrinter(*format, cmd.stdout)
+	if err != nil {
+		return err
+	}
+
+	s, err := cmd.listenServer(name, &sf)
+	if err != nil {
+		return err
+	}
+
+	return cmd.serve(ctx, s, *count, func(m *ipc.Message) error {
+
+		if !*quiet {
+			if err := p.print(m); err != nil {
+				return err
+			}
+		}
+
+		return s.WriteMessage(&ipc.Message{MsgType: m.MsgType, Data: m.Data, Headers: m.Headers})
+	})
+}
+
+// serve - passes each message received to handle, and prints the clients connecting and disconnecting, until ctx is cancelled
+func (cmd *command) serve(ctx context.Context, s *ipc.Server, count int, handle func(*ipc.Message) error) error {
+
+	done := make(chan struct{})
+	defer close(done)
+
+	msgs := readLoop(s.Read, false, done)
+
+	for n := 0; count == 0 || n < count; {
+		select {
+		case r := <-msgs:
+			if r.err != nil {
+				fmt.Fprintln(cmd.stderr, "error:", r.err)
+				continue
+			}
+			if r.m.MsgType < 1 {
+				continue
+			}
+			if err := handle(r.m); err != nil {
+				s.Close()
+				return err
+			}
+			n++
+		case e := <-s.Events():
+			switch {
+			case e.Err != nil:
+				fmt.Fprintln(cmd.stderr, "error:", e.Err)
+			case e.Status == ipc.Listening:
+				fmt.Fprintln(cmd.stderr, "listening")
+			case e.Status == ipc.Connected && e.Peer != nil:
+				fmt.Fprintf(cmd.stderr, "client connected, ID %q, encryption %t\n", e.Peer.ClientID, e.Peer.Encryption)
+			case e.Status == ipc.Disconnected:
+				fmt.Fprintln(cmd.stderr, "client disconnected")
+			}
+		case <-ctx.Done():
+			return shutdown(s)
+		}
+	}
+
+	return shutdown(s)
+}
+
+func (cmd *command) info(ctx context.Context, args []string) error {
+
+	var cf clientFlags
+
+	fs := flag.NewFlagSet("info", flag.ContinueOnError)
+	cf.register(fs)
+	format := fs.String("format", "text", "how the details are printed: text or json")
+
+	name, err := cmd.parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("unknown format %q, use text or json", *format)
+	}
+
+	c, peer, err := cmd.dial(ctx, name, &cf)
+	if err != nil {
+		return err
+	}
+
+	in := handshakeInfo{
+		Name:       name,
+		Addr:       peer.Addr,
+		Encryption: peer.Encryption,
+		MaxMsgSize: peer.MaxMsgSize,
+		ClientID:   c.ClientID(),
+	}
+
+	if *format == "json" {
+		err = writeJSON(cmd.stdout, in)
+	} else {
+		tw := tabwriter.NewWriter(cmd.stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(tw, "name\t%s\n", in.Name)
+		fmt.Fprintf(tw, "address\t%s\n", in.Addr)
+		fmt.Fprintf(tw, "encryption\t%t\n", in.Encryption)
+		fmt.Fprintf(tw, "max message size\t%d\n", in.MaxMsgSize)
+		fmt.Fprintf(tw, "client ID\t%s\n", in.ClientID)
+		err = tw.Flush()
+	}
+
+	if err != nil {
+		c.Close()
+		return err
+	}
+
+	return shutdown(c)
+}
+
+// handshakeInfo - printed by the info command
+type handshakeInfo struct {
+	Name       string `json:"name"`
+	Addr       string `json:"address"`
+	Encryption bool   `json:"encryption"`
+	MaxMsgSize int    `json:"max_msg_size"`
+	ClientID   string `json:"client_id"`
+}
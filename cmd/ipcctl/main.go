@@ -0,0 +1,106 @@
+// Command ipcctl connects to golang-ipc sockets and named pipes from the command line.
+//
+//	ipcctl send [flags] <name>     send a message, e.g. ipcctl send --type 5 --data @request.json example
+//	ipcctl listen [flags] <name>   print the messages received, as a client or with --server as the server
+//	ipcctl echo [flags] <name>     run a server that sends each message back to the client
+//	ipcctl info [flags] <name>     connect and print the details agreed during the handshake
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+)
+
+const usage = `usage: ipcctl <command> [flags] <name>
+
+commands:
+  send     send a message and optionally wait for the reply
+  listen   print the messages received
+  echo     run a server that sends each message back
+  info     print the details agreed during the handshake
+
+run "ipcctl <command> -h" for the flags of each command
+`
+
+// errUsage - the arguments were wrong, the usage has already been printed
+var errUsage = errors.New("usage")
+
+func main() {
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err := run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+
+	switch {
+	case err == nil:
+	case errors.Is(err, errUsage):
+		os.Exit(2)
+	default:
+		fmt.Fprintln(os.Stderr, "ipcctl:", err)
+		os.Exit(1)
+	}
+}
+
+// run - runs the command in args until it finishes or ctx is cancelled
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return errUsage
+	}
+
+	cmd := &command{name: args[0], stdin: stdin, stdout: stdout, stderr: stderr}
+
+	switch args[0] {
+	case "send":
+		return cmd.send(ctx, args[1:])
+	case "listen":
+		return cmd.listen(ctx, args[1:])
+	case "echo":
+		return cmd.echo(ctx, args[1:])
+	case "info":
+		return cmd.info(ctx, args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return nil
+	}
+
+	fmt.Fprintf(stderr, "ipcctl: unknown command %q\n\n%s", args[0], usage)
+	return errUsage
+}
+
+// command - the state shared by each command
+type command struct {
+	name   string
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// parse - parses the flags and returns the name of the socket, the only argument left after them
+func (cmd *command) parse(fs *flag.FlagSet, args []string) (string, error) {
+
+	fs.SetOutput(cmd.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(cmd.stderr, "usage: ipcctl %s [flags] <name>\n\nflags:\n", cmd.name)
+		fs.PrintDefaults()
+	}
+
+	// the flag package has already printed the error and usage
+	if err := fs.Parse(args); err != nil {
+		return "", errUsage
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return "", errUsage
+	}
+
+	return fs.Arg(0), nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ipc "github.com/james-barrow/golang-ipc"
+)
+
+func TestReadData(t *testing.T) {
+
+	b, err := readData("hello", nil)
+	if err != nil || string(b) != "hello" {
+		t.Errorf("expected the data as it is, got %q %v", b, err)
+	}
+
+	b, err = readData("@-", strings.NewReader("from stdin"))
+	if err != nil || string(b) != "from stdin" {
+		t.Errorf("expected the data from stdin, got %q %v", b, err)
+	}
+
+	file := filepath.Join(t.TempDir(), "data")
+	os.WriteFile(file, []byte("from a file"), 0600)
+
+	b, err = readData("@"+file, nil)
+	if err != nil || string(b) != "from a file" {
+		t.Errorf("expected the data from the file, got %q %v", b, err)
+	}
+
+	if _, err := readData("@"+file+".missing", nil); err == nil {
+		t.Error("a missing file should be an error")
+	}
+}
+
+func TestHeaderFlag(t *testing.T) {
+
+	var h headerFlag
+
+	h.Set("b=2")
+	h.Set("a=x=y")
+
+	if h.m["a"] != "x=y" || h.m["b"] != "2" {
+		t.Errorf("unexpected headers %v", h.m)
+	}
+
+	if h.String() != "a=x=y b=2" {
+		t.Errorf("unexpected string %q", h.String())
+	}
+
+	if err := h.Set("novalue"); err == nil {
+		t.Error("a header without = should be rejected")
+	}
+}
+
+func TestPrinter(t *testing.T) {
+
+	m := &ipc.Message{MsgType: 5, Data: []byte("hi"), Headers: map[string]string{"k": "v"}}
+
+	var buf bytes.Buffer
+
+	p, _ := newPrinter("text", &buf)
+	p.print(m)
+	if buf.String() != "[5 k=v] hi\n" {
+		t.Errorf("unexpected text %q", buf.String())
+	}
+
+	buf.Reset()
+	p, _ = newPrinter("hex", &buf)
+	p.print(m)
+	if !strings.HasPrefix(buf.String(), "[5 k=v] 2 bytes\n00000000  68 69") {
+		t.Errorf("unexpected hex %q", buf.String())
+	}
+
+	buf.Reset()
+	p, _ = newPrinter("json", &buf)
+	p.print(&ipc.Message{MsgType: 6, Data: []byte{0xff, 0xfe}})
+
+	var jm map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &jm); err != nil {
+		t.Fatal(err)
+	}
+	if jm["type"] != float64(6) || jm["data_base64"] != "//4=" || jm["data"] != nil {
+		t.Errorf("unexpected json %s", buf.String())
+	}
+
+	if _, err := newPrinter("xml", &buf); err == nil {
+		t.Error("an unknown format should be rejected")
+	}
+}
+
+func TestUsage(t *testing.T) {
+
+	var stderr bytes.Buffer
+
+	if err := run(context.Background(), nil, nil, &stderr, &stderr); err != errUsage {
+		t.Errorf("expected errUsage without a command, got %v", err)
+	}
+
+	if err := run(context.Background(), []string{"bogus"}, nil, &stderr, &stderr); err != errUsage {
+		t.Errorf("expected errUsage for an unknown command, got %v", err)
+	}
+
+	if err := run(context.Background(), []string{"send"}, nil, &stderr, &stderr); err != errUsage {
+		t.Errorf("expected errUsage without a name, got %v", err)
+	}
+
+	if err := run(context.Background(), []string{"send", "--type", "0", "test_ipcctl_type"}, nil, &stderr, &stderr); err == nil {
+		t.Error("message type 0 should be rejected")
+	}
+}
+
+func TestSendEcho(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var echoOut, echoErr bytes.Buffer
+	echoed := make(chan error, 1)
+
+	go func() {
+		echoed <- run(ctx, []string{"echo", "--count", "1", "--encryption=false", "test_ipcctl_echo"}, nil, &echoOut, &echoErr)
+	}()
+
+	var out, stderr bytes.Buffer
+
+	err := run(ctx, []string{"send", "--type", "5", "--data", "@-", "--header", "k=v", "--wait", "--format", "json", "--encryption=false", "test_ipcctl_echo"},
+		strings.NewReader("ping"), &out, &stderr)
+	if err != nil {
+		t.Fatal(err, stderr.String())
+	}
+
+	if strings.TrimSpace(out.String()) != `{"type":5,"headers":{"k":"v"},"data":"ping"}` {
+		t.Errorf("unexpected reply %q", out.String())
+	}
+
+	if err := <-echoed; err != nil {
+		t.Fatal(err)
+	}
+
+	if echoOut.String() != "[5 k=v] ping\n" {
+		t.Errorf("unexpected echo output %q", echoOut.String())
+	}
+
+	if !strings.Contains(echoErr.String(), "client connected") {
+		t.Errorf("expected the echo server to print the client connecting, got %q", echoErr.String())
+	}
+}
+
+func TestInfo(t *testing.T) {
+
+	s, err := ipc.NewServer("test_ipcctl_info", ipc.WithMaxMsgSize(4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	go func() {
+		for {
+			if _, err := s.Read(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var out, stderr bytes.Buffer
+
+	if err := run(ctx, []string{"info", "--format", "json", "--id", "ipcctl", "test_ipcctl_info"}, nil, &out, &stderr); err != nil {
+		t.Fatal(err, stderr.String())
+	}
+
+	var in handshakeInfo
+	if err := json.Unmarshal(out.Bytes(), &in); err != nil {
+		t.Fatal(err)
+	}
+
+	if !in.Encryption || in.MaxMsgSize != 4096 || in.ClientID != "ipcctl" || in.Name != "test_ipcctl_info" {
+		t.Errorf("unexpected handshake details %+v", in)
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+
+	var out, stderr bytes.Buffer
+
+	err := run(context.Background(), []string{"info", "--timeout", "500ms", "test_ipcctl_nobody"}, nil, &out, &stderr)
+	if err == nil {
+		t.Fatal("expected an error when nothing is listening")
+	}
+}
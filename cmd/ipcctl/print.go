@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	ipc "github.com/james-barrow/golang-ipc"
+)
+
+// printer - prints received messages in one of the formats
+type printer struct {
+	format string
+	w      io.Writer
+}
+
+func newPrinter(format string, w io.Writer) (*printer, error) {
+
+	switch format {
+	case "text", "hex", "json":
+		return &printer{format: format, w: w}, nil
+	}
+
+	return nil, fmt.Errorf("unknown format %q, use text, hex or json", format)
+}
+
+// print - text is one line per message, [type key=value] data. hex adds a dump of the data and json is one object per line
+func (p *printer) print(m *ipc.Message) error {
+
+	switch p.format {
+	case "hex":
+		_, err := fmt.Fprintf(p.w, "[%s] %d bytes\n%s", prefix(m), len(m.Data), hex.Dump(m.Data))
+		return err
+	case "json":
+		return writeJSON(p.w, newJSONMessage(m))
+	}
+
+	_, err := fmt.Fprintf(p.w, "[%s] %s\n", prefix(m), m.Data)
+	return err
+}
+
+// prefix - the message type followed by the headers
+func prefix(m *ipc.Message) string {
+
+	if len(m.Headers) == 0 {
+		return fmt.Sprint(m.MsgType)
+	}
+
+	return fmt.Sprint(m.MsgType, " ", headerString(m.Headers))
+}
+
+// headerString - key=value pairs sorted by key
+func headerString(headers map[string]string) string {
+
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + "=" + headers[k]
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// jsonMessage - the data is a string if it's valid UTF-8, otherwise it's base64 encoded in DataBase64
+type jsonMessage struct {
+	Type       int               `json:"type"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Data       *string           `json:"data,omitempty"`
+	DataBase64 []byte            `json:"data_base64,omitempty"`
+}
+
+func newJSONMessage(m *ipc.Message) jsonMessage {
+
+	jm := jsonMessage{Type: m.MsgType, Headers: m.Headers}
+
+	if utf8.Valid(m.Data) {
+		s := string(m.Data)
+		jm.Data = &s
+	} else {
+		jm.DataBase64 = m.Data
+	}
+
+	return jm
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+
+	return json.NewEncoder(w).Encode(v)
+}
+
+// readData - the data flag, @file reads the file and @- reads stdin
+func readData(data string, stdin io.Reader) ([]byte, error) {
+
+	switch {
+	case data == "@-":
+		return io.ReadAll(stdin)
+	case strings.HasPrefix(data, "@"):
+		return os.ReadFile(data[1:])
+	}
+
+	return []byte(data), nil
+}
+
+// headerFlag - collects each key=value passed to --header
+type headerFlag struct {
+	m map[string]string
+}
+
+func (h *headerFlag) String() string {
+
+	if h == nil {
+		return ""
+	}
+
+	return headerString(h.m)
+}
+
+func (h *headerFlag) Set(s string) error {
+
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return errors.New("header must be key=value")
+	}
+
+	if h.m == nil {
+		h.m = make(map[string]string)
+	}
+	h.m[k] = v
+
+	return nil
+}
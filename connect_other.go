@@ -18,19 +18,27 @@ func (s *Server) run() error {
 	base := "/tmp/"
 	sock := ".sock"
 
-	if err := os.RemoveAll(base + s.name + sock); err != nil {
-		return err
-	}
+	var listen net.Listener
+	var err error
+
+	if s.activated {
+		// systemd created the socket, it's used as it is
+		listen, err = activationListener(s.name)
+	} else {
+		if err := os.RemoveAll(base + s.name + sock); err != nil {
+			return err
+		}
 
-	var oldUmask int
-	if s.unMask {
-		oldUmask = syscall.Umask(0)
-	}
+		var oldUmask int
+		if s.unMask {
+			oldUmask = syscall.Umask(0)
+		}
 
-	listen, err := net.Listen("unix", base+s.name+sock)
+		listen, err = net.Listen("unix", base+s.name+sock)
 
-	if s.unMask {
-		syscall.Umask(oldUmask)
+		if s.unMask {
+			syscall.Umask(oldUmask)
+		}
 	}
 
 	if err != nil {
@@ -39,56 +47,101 @@ func (s *Server) run() error {
 
 	s.listen = listen
 
-	go s.acceptLoop()
+	s.setStatus(Listening)
 
-	s.status = Listening
+	s.wg.Add(1)
+	go s.acceptLoop()
 
 	return nil
 
 }
 
+// removeSocket - removes the socket file once the server has shut down
+func (s *Server) removeSocket() {
+
+	// the socket belongs to systemd, which keeps it for the next time the service starts
+	if s.activated {
+		return
+	}
+
+	base := "/tmp/"
+	sock := ".sock"
+
+	os.Remove(base + s.name + sock)
+}
+
 // Client connect to the unix socket created by the server -  for unix and linux
 func (c *Client) dial() error {
 
 	base := "/tmp/"
 	sock := ".sock"
 
-	startTime := time.Now()
+	startTime := c.clock.Now()
 
-	for {
-		
-		if c.timeout != 0 {
+	for attempt := 1; ; attempt++ {
 
-			if time.Since(startTime).Seconds() > c.timeout {
-				c.status = Closed
-				return errors.New("timed out trying to connect")
-			}
+		status := c.getStatus()
+
+		if status == Closing {
+			return errors.New("client has closed the connection")
+		}
+
+		if status == ReConnecting {
+			c.metrics.ReconnectAttempt()
+		}
+
+		var conn net.Conn
+		var err error
+
+		if c.transport != nil {
+			conn, err = c.transport.Dial(c.Name)
+		} else {
+			conn, err = net.Dial("unix", base+c.Name+sock)
 		}
 
-		conn, err := net.Dial("unix", base+c.Name+sock)
 		if err != nil {
 
-			if strings.Contains(err.Error(), "connect: no such file or directory") {
+			if c.transport != nil {
+				// the server isn't listening yet
+			} else if strings.Contains(err.Error(), "connect: no such file or directory") {
 
 			} else if strings.Contains(err.Error(), "connect: connection refused") {
 
 			} else {
-				c.received <- &Message{Err: err, MsgType: -1}
+				c.reportError(err, -1)
 			}
 
 		} else {
 
+			c.mutex.Lock()
 			c.conn = conn
+			c.mutex.Unlock()
+
+			start := time.Now()
+
+			// a server that stops part way through the handshake is treated as a failed connection
+			conn.SetDeadline(start.Add(handshakeTimeout))
 
 			err = c.handshake()
-			if err != nil {
-				return err
+			if err != errServerBusy {
+				if err != nil {
+					return err
+				}
+
+				conn.SetDeadline(time.Time{})
+
+				c.metrics.Handshake(time.Since(start))
+
+				return nil
 			}
 
-			return nil
+			// the server is still busy with another client, wait and try again
+			conn.Close()
 		}
 
-		time.Sleep(c.retryTimer * time.Second)
+		if err := c.retryWait(attempt, startTime); err != nil {
+			return err
+		}
 
 	}
 
@@ -2,6 +2,7 @@ package ipc
 
 import (
 	"errors"
+	"net"
 	"strings"
 	"time"
 
@@ -29,33 +30,52 @@ func (s *Server) run() error {
 
 	s.listen = listen
 
-	s.status = Listening
+	s.setStatus(Listening)
 
+	s.wg.Add(1)
 	go s.acceptLoop()
 
 	return nil
 
 }
 
+// removeSocket - named pipes are removed by windows when the last handle is closed
+func (s *Server) removeSocket() {}
+
 // Client function
 // dial - attempts to connect to a named pipe created by the server
 func (c *Client) dial() error {
 
 	var pipeBase = `\\.\pipe\`
 
-	startTime := time.Now()
+	startTime := c.clock.Now()
 
-	for {
-		if c.timeout != 0 {
-			if time.Since(startTime).Seconds() > c.timeout {
-				c.status = Closed
-				return errors.New("timed out trying to connect")
-			}
+	for attempt := 1; ; attempt++ {
+
+		status := c.getStatus()
+
+		if status == Closing {
+			return errors.New("client has closed the connection")
+		}
+
+		if status == ReConnecting {
+			c.metrics.ReconnectAttempt()
+		}
+
+		var pn net.Conn
+		var err error
+
+		if c.transport != nil {
+			pn, err = c.transport.Dial(c.Name)
+		} else {
+			pn, err = winio.DialPipe(pipeBase+c.Name, nil)
 		}
-		pn, err := winio.DialPipe(pipeBase+c.Name, nil)
+
 		if err != nil {
 
-			if strings.Contains(err.Error(), "the system cannot find the file specified.") == true {
+			if c.transport != nil {
+				// the server isn't listening yet
+			} else if strings.Contains(err.Error(), "the system cannot find the file specified.") == true {
 
 			} else {
 				return err
@@ -63,16 +83,34 @@ func (c *Client) dial() error {
 
 		} else {
 
+			c.mutex.Lock()
 			c.conn = pn
+			c.mutex.Unlock()
+
+			start := time.Now()
+
+			// a server that stops part way through the handshake is treated as a failed connection
+			pn.SetDeadline(start.Add(handshakeTimeout))
 
 			err = c.handshake()
-			if err != nil {
-				return err
+			if err != errServerBusy {
+				if err != nil {
+					return err
+				}
+
+				pn.SetDeadline(time.Time{})
+
+				c.metrics.Handshake(time.Since(start))
+				return nil
 			}
-			return nil
+
+			// the server is still busy with another client, wait and try again
+			pn.Close()
 		}
 
-		time.Sleep(c.retryTimer * time.Second)
+		if err := c.retryWait(attempt, startTime); err != nil {
+			return err
+		}
 
 	}
 }
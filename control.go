@@ -0,0 +1,83 @@
+package ipc
+
+import (
+	"crypto/cipher"
+
+	"github.com/james-barrow/golang-ipc/wire"
+)
+
+// Control messages are sent with message type 0 and are never returned by Read(), see the wire package for the format.
+const (
+	ctrlHeaders = wire.CtrlHeaders
+	ctrlGoodbye = wire.CtrlGoodbye
+	ctrlFiles   = wire.CtrlFiles
+	ctrlChunk   = wire.CtrlChunk
+	ctrlCaps    = wire.CtrlCaps
+	ctrlHello   = wire.CtrlHello
+)
+
+// Capabilities the client sends during the handshake. The server only sends control messages to clients that have the capability.
+const (
+	capHeaders      = wire.CapHeaders
+	capSharedMemory = wire.CapSharedMemory
+	capFiles        = wire.CapFiles
+	capChunks       = wire.CapChunks
+	capClientID     = wire.CapClientID
+)
+
+// serverCaps - sent to the client in a ctrlCaps control message
+const serverCaps = capHeaders | capChunks
+
+// Standard header keys
+const (
+	HeaderContentType   = "content-type"
+	HeaderCorrelationID = "correlation-id"
+	HeaderTimestamp     = "timestamp" // RFC 3339 with nanoseconds
+	HeaderSender        = "sender"
+	HeaderTraceParent   = "traceparent" // W3C trace context, see WriteContext()
+	HeaderTraceState    = "tracestate"
+	HeaderDeadline      = "deadline" // RFC 3339 with nanoseconds, set from Message.Deadline and never kept in Message.Headers, see WithDeadline()
+)
+
+// frame - builds a message ready to be written to the connection, [length][msgType + data].
+// The msgType and data are encrypted if g is not nil.
+func frame(g cipher.AEAD, msgType int, data []byte) ([]byte, error) {
+
+	return wire.AppendFrame(nil, g, msgType, data)
+}
+
+// appendHeadersFrame - appends the control message carrying the headers for the next message
+func appendHeadersFrame(dst []byte, g cipher.AEAD, headers map[string]string) ([]byte, error) {
+
+	return wire.AppendFrame(dst, g, 0, append([]byte{ctrlHeaders}, wire.EncodeHeaders(headers)...))
+}
+
+// control - decodes a control message, returns the control code and the headers to attach to the next message received
+func control(data []byte) (byte, map[string]string) {
+
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	switch data[0] {
+	case ctrlHeaders:
+		headers, err := wire.DecodeHeaders(data[1:])
+		if err != nil {
+			return 0, nil
+		}
+		return ctrlHeaders, headers
+	}
+
+	return data[0], nil
+}
+
+// goodbye - the control message queued by Shutdown(), the write goroutine exits once it has been sent
+func goodbye() *Message {
+
+	return &Message{MsgType: 0, Data: []byte{ctrlGoodbye}}
+}
+
+func isGoodbye(m *Message) bool {
+
+	return m.MsgType == 0 && len(m.Data) == 1 && m.Data[0] == ctrlGoodbye
+}
@@ -0,0 +1,121 @@
+package ipc
+
+import "time"
+
+// WriteOption - optional settings for a message passed to Write() or TryWrite()
+type WriteOption func(*Message)
+
+// WithDeadline - the message is dropped if it hasn't been written by t, and discarded by the receiver if it arrives after t
+func WithDeadline(t time.Time) WriteOption {
+
+	return func(m *Message) {
+		m.Deadline = t
+		m.ttl = 0
+	}
+}
+
+// WithTTL - the message has a deadline ttl after Write() is called, by the client's clock on a client, see WithDeadline().
+// The option can be reused, each message gets its own deadline
+func WithTTL(ttl time.Duration) WriteOption {
+
+	return func(m *Message) {
+		m.Deadline = time.Time{}
+		m.ttl = ttl
+	}
+}
+
+// newWrite - the message for Write(), now is when it's being written
+func newWrite(now time.Time, msgType int, message []byte, opts []WriteOption) *Message {
+
+	m := &Message{MsgType: msgType, Data: message}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	if m.ttl != 0 {
+		m.Deadline = now.Add(m.ttl)
+		m.ttl = 0
+	}
+
+	return m
+}
+
+// expired - whether the message has a deadline that has passed
+func (m *Message) expired(now time.Time) bool {
+
+	return !m.Deadline.IsZero() && now.After(m.Deadline)
+}
+
+// unexpired - the message without any expired messages, or nil if they have all expired.
+// For a batch the expired messages are left out, the rest are still written together.
+func unexpired(m *Message, metrics Metrics, now time.Time) *Message {
+
+	if m.batch == nil {
+		if m.expired(now) {
+			metrics.MessageDropped(m.MsgType)
+			closeFiles(m.Files)
+			return nil
+		}
+		return m
+	}
+
+	batch := make([]*Message, 0, len(m.batch))
+
+	for _, mm := range m.batch {
+		if mm.expired(now) {
+			metrics.MessageDropped(mm.MsgType)
+			continue
+		}
+		batch = append(batch, mm)
+	}
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	return &Message{batch: batch, Priority: m.Priority}
+}
+
+// frameHeaders - the headers sent with the message, including its deadline.
+// Only Deadline sets the deadline header, one in Headers, e.g. from a message that was recorded, isn't sent
+func (m *Message) frameHeaders() map[string]string {
+
+	_, reserved := m.Headers[HeaderDeadline]
+	if m.Deadline.IsZero() && !reserved {
+		return m.Headers
+	}
+
+	headers := make(map[string]string, len(m.Headers)+1)
+	for k, v := range m.Headers {
+		if k != HeaderDeadline {
+			headers[k] = v
+		}
+	}
+
+	if !m.Deadline.IsZero() {
+		headers[HeaderDeadline] = m.Deadline.UTC().Format(time.RFC3339Nano)
+	}
+
+	if len(headers) == 0 {
+		return nil
+	}
+
+	return headers
+}
+
+// deadline - the deadline sent in the headers, zero if there isn't one
+func deadline(headers map[string]string) time.Time {
+
+	d, ok := headers[HeaderDeadline]
+	if !ok {
+		return time.Time{}
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, d)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return t
+}
@@ -10,6 +10,8 @@ import (
 	"errors"
 	"io"
 	"net"
+
+	"github.com/james-barrow/golang-ipc/wire"
 )
 
 func (sc *Server) keyExchange() ([32]byte, error) {
@@ -101,45 +103,20 @@ func sendPublic(conn net.Conn, pub *ecdsa.PublicKey) error {
 	return nil
 }
 
-func recvPublic(conn net.Conn) (*ecdsa.PublicKey, error) {
+func recvPublic(conn io.Reader) (*ecdsa.PublicKey, error) {
 
-	buff := make([]byte, 98)
-	i, err := conn.Read(buff)
-	if err != nil {
+	// the key can arrive in more than one read
+	buff := make([]byte, wire.PublicKeySize)
+	if _, err := io.ReadFull(conn, buff); err != nil {
 		return nil, errors.New("didn't received public key")
 	}
 
-	if i != 97 {
-		return nil, errors.New("public key received isn't valid length")
-	}
-
-	recvdPub := bytesToPublicKey(buff[:i])
-
-	if !recvdPub.IsOnCurve(recvdPub.X, recvdPub.Y) {
-		return nil, errors.New("didn't received valid public key")
-	}
-
-	return recvdPub, nil
+	return wire.UnmarshalPublicKey(buff)
 }
 
 func publicKeyToBytes(pub *ecdsa.PublicKey) []byte {
 
-	if pub == nil || pub.X == nil || pub.Y == nil {
-		return nil
-	}
-
-	return elliptic.Marshal(elliptic.P384(), pub.X, pub.Y)
-}
-
-func bytesToPublicKey(recvdPub []byte) *ecdsa.PublicKey {
-
-	if len(recvdPub) == 0 {
-		return nil
-	}
-
-	x, y := elliptic.Unmarshal(elliptic.P384(), recvdPub)
-	return &ecdsa.PublicKey{Curve: elliptic.P384(), X: x, Y: y}
-
+	return wire.MarshalPublicKey(pub)
 }
 
 func createCipher(shared [32]byte) (*cipher.AEAD, error) {
@@ -156,30 +133,3 @@ func createCipher(shared [32]byte) (*cipher.AEAD, error) {
 
 	return &gcm, nil
 }
-
-func encrypt(g cipher.AEAD, data []byte) ([]byte, error) {
-
-	nonce := make([]byte, g.NonceSize())
-
-	_, err := io.ReadFull(rand.Reader, nonce)
-
-	return g.Seal(nonce, nonce, data, nil), err
-
-}
-
-func decrypt(g cipher.AEAD, recdData []byte) ([]byte, error) {
-
-	nonceSize := g.NonceSize()
-	if len(recdData) < nonceSize {
-		return nil, errors.New("not enough data to decrypt")
-	}
-
-	nonce, recdData := recdData[:nonceSize], recdData[nonceSize:]
-	plain, err := g.Open(nil, nonce, recdData, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	return plain, nil
-
-}
@@ -0,0 +1,178 @@
+package ipc
+
+import "net"
+
+// Events - returns a channel that receives every status change and error on the server.
+// The channel is buffered, if it is not read from new events are dropped once it is full.
+func (s *Server) Events() <-chan Event {
+	return s.events
+}
+
+// Events - returns a channel that receives every status change and error on the client.
+// The channel is buffered, if it is not read from new events are dropped once it is full.
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// reportError - passes an error to both Events() and Read()
+func (s *Server) reportError(err error, msgType int) {
+
+	s.mutex.Lock()
+	sendEvent(s.events, s.recorder, Event{Status: s.status, OldStatus: s.status, Err: err, Peer: s.peer})
+	s.mutex.Unlock()
+
+	s.deliver(&Message{Err: err, MsgType: msgType})
+}
+
+// dropConn - closes a connection whose handshake failed, the server carries on listening for the next client.
+// The error is sent to Events(), and to Read() only if it's waiting, so a bad client can't hold up the accept loop
+func (s *Server) dropConn(conn net.Conn, err error) {
+
+	conn.Close()
+
+	s.mutex.Lock()
+	sendEvent(s.events, s.recorder, Event{Status: s.status, OldStatus: s.status, Err: err})
+	s.mutex.Unlock()
+
+	select {
+	case s.received <- &Message{Err: err, MsgType: -1}:
+	default:
+	}
+}
+
+// closeRead - moves to Closed once Close() or Shutdown() has closed the connection, then ends Read() with err.
+// Unlike statusChange() and reportError() it never waits for Read(), so closing doesn't depend on something reading.
+// The next Read() returns the Closed status, unless it's suppressed, then every Read() after it returns the error
+func (s *Server) closeRead(err error) {
+
+	notify := s.setStatus(Closed) && !s.noStatus
+
+	s.closeOnce.Do(func() {
+		s.mutex.Lock()
+		sendEvent(s.events, s.recorder, Event{Status: s.status, OldStatus: s.status, Err: err, Peer: s.peer})
+		s.closeStatus = notify
+		s.closeErr = err
+		s.mutex.Unlock()
+
+		close(s.closed)
+	})
+}
+
+// deliver - passes m to Read(). Once Close() or Shutdown() has been called it gives up waiting and returns false,
+// so the server's goroutines can always exit whether or not anything is reading
+func (s *Server) deliver(m *Message) bool {
+
+	// a Read() that's already waiting gets the message even when closing
+	select {
+	case s.received <- m:
+		return true
+	default:
+	}
+
+	select {
+	case s.received <- m:
+		return true
+	case <-s.closing:
+		return false
+	}
+}
+
+// setPeer - sets the peer reported in events, nil once the connection has ended
+func (s *Server) setPeer(p *Peer) {
+
+	s.mutex.Lock()
+	s.peer = p
+	s.mutex.Unlock()
+}
+
+// reportError - passes an error to both Events() and Read()
+func (c *Client) reportError(err error, msgType int) {
+
+	c.mutex.Lock()
+	sendEvent(c.events, c.recorder, Event{Status: c.status, OldStatus: c.status, Err: err, Peer: c.peer})
+	c.mutex.Unlock()
+
+	c.deliver(&Message{Err: err, MsgType: msgType})
+}
+
+// closeRead - moves to Closed once Close() or Shutdown() has closed the connection, then ends Read() with err.
+// Unlike statusChange() and reportError() it never waits for Read(), so closing doesn't depend on something reading.
+// The next Read() returns the Closed status, unless it's suppressed, then every Read() after it returns the error
+func (c *Client) closeRead(err error) {
+
+	notify := c.setStatus(Closed) && !c.noStatus
+
+	c.closeOnce.Do(func() {
+		c.mutex.Lock()
+		sendEvent(c.events, c.recorder, Event{Status: c.status, OldStatus: c.status, Err: err, Peer: c.peer})
+		c.closeStatus = notify
+		c.closeErr = err
+		c.mutex.Unlock()
+
+		close(c.closed)
+	})
+}
+
+// deliver - passes m to Read(). Once Close() or Shutdown() has been called it gives up waiting and returns false,
+// so the client's goroutines can always exit whether or not anything is reading
+func (c *Client) deliver(m *Message) bool {
+
+	// a Read() that's already waiting gets the message even when closing
+	select {
+	case c.received <- m:
+		return true
+	default:
+	}
+
+	select {
+	case c.received <- m:
+		return true
+	case <-c.closing:
+		return false
+	}
+}
+
+// setPeer - sets the peer reported in events, nil once the connection has ended
+func (c *Client) setPeer(p *Peer) {
+
+	c.mutex.Lock()
+	c.peer = p
+	c.mutex.Unlock()
+}
+
+// sendEvent - non-blocking send, the event is dropped if nobody is reading the channel. The recorder always sees it
+func sendEvent(events chan Event, recorder Recorder, e Event) {
+
+	if recorder != nil {
+		recorder.RecordEvent(e)
+	}
+
+	if events == nil {
+		return
+	}
+
+	select {
+	case events <- e:
+	default:
+	}
+}
+
+func newPeer(conn net.Conn, encryption bool, maxMsgSize int) *Peer {
+
+	p := &Peer{
+		Encryption: encryption,
+		MaxMsgSize: maxMsgSize,
+	}
+
+	if addr := conn.RemoteAddr(); addr != nil {
+		p.Addr = addr.String()
+	}
+
+	if p.Addr == "" {
+		if addr := conn.LocalAddr(); addr != nil {
+			p.Addr = addr.String()
+		}
+	}
+
+	return p
+}
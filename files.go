@@ -0,0 +1,95 @@
+package ipc
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// maxFiles - the most files that can be sent with one message
+const maxFiles = 32
+
+// WriteWithFiles - writes a message along with open files, or sockets, for the client to use.
+// The files are duplicated so the caller can close them as soon as WriteWithFiles returns, the client owns the copies in Message.Files.
+// Only supported on linux unix sockets without encryption.
+func (s *Server) WriteWithFiles(msgType int, message []byte, files []*os.File) error {
+
+	s.mutex.Lock()
+	conn, peer, caps := s.conn, s.peer, s.peerCaps
+	s.mutex.Unlock()
+
+	if err := checkFiles(conn, peer, files); err != nil {
+		return err
+	}
+
+	if caps&capFiles == 0 {
+		return errors.New("the client doesn't support receiving files")
+	}
+
+	dups, err := dupFiles(files)
+	if err != nil {
+		return err
+	}
+
+	err = s.queue(&Message{MsgType: msgType, Data: message, Files: dups}, s.writePolicy)
+	if err != nil {
+		closeFiles(dups)
+	}
+
+	return err
+}
+
+// WriteWithFiles - writes a message along with open files, or sockets, for the server to use.
+// The files are duplicated so the caller can close them as soon as WriteWithFiles returns, the server owns the copies in Message.Files.
+// Only supported on linux unix sockets without encryption, servers older than this version receive the message without the files.
+func (c *Client) WriteWithFiles(msgType int, message []byte, files []*os.File) error {
+
+	c.mutex.Lock()
+	conn, peer := c.conn, c.peer
+	c.mutex.Unlock()
+
+	if err := checkFiles(conn, peer, files); err != nil {
+		return err
+	}
+
+	dups, err := dupFiles(files)
+	if err != nil {
+		return err
+	}
+
+	err = c.queue(&Message{MsgType: msgType, Data: message, Files: dups}, c.writePolicy)
+	if err != nil {
+		closeFiles(dups)
+	}
+
+	return err
+}
+
+// checkFiles - whether the files can be sent over the connection
+func checkFiles(conn net.Conn, peer *Peer, files []*os.File) error {
+
+	if len(files) > maxFiles {
+		return errors.New("too many files to send with one message")
+	}
+
+	if peer == nil {
+		return errors.New("not connected")
+	}
+
+	if peer.Encryption {
+		return errors.New("files can't be sent over an encrypted connection")
+	}
+
+	if !filesSupported(conn) {
+		return errors.New("the connection doesn't support passing files")
+	}
+
+	return nil
+}
+
+func closeFiles(files []*os.File) {
+
+	for _, f := range files {
+		f.Close()
+	}
+}
@@ -0,0 +1,149 @@
+//go:build linux
+// +build linux
+
+package ipc
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileConn - reads with recvmsg so files sent with SCM_RIGHTS are kept until the control message that claims them is read
+type fileConn struct {
+	*net.UnixConn
+
+	oob []byte
+
+	mutex sync.Mutex // guards files, Close() can be called on another goroutine while Read() is waiting
+	files []*os.File
+}
+
+func filesSupported(conn net.Conn) bool {
+
+	_, ok := conn.(*net.UnixConn)
+	return ok
+}
+
+// newFileConn - wraps conn so files can be received, unless it is encrypted or doesn't support them
+func newFileConn(conn net.Conn, encrypted bool) net.Conn {
+
+	uc, ok := conn.(*net.UnixConn)
+	if !ok || encrypted {
+		return conn
+	}
+
+	return &fileConn{UnixConn: uc, oob: make([]byte, unix.CmsgSpace(4*maxFiles))}
+}
+
+func (c *fileConn) Read(b []byte) (int, error) {
+
+	n, oobn, flags, _, err := c.UnixConn.ReadMsgUnix(b, c.oob)
+
+	if oobn > 0 {
+		msgs, _ := unix.ParseSocketControlMessage(c.oob[:oobn])
+
+		c.mutex.Lock()
+		for i := range msgs {
+			fds, err := unix.ParseUnixRights(&msgs[i])
+			if err != nil {
+				continue
+			}
+			for _, fd := range fds {
+				c.files = append(c.files, os.NewFile(uintptr(fd), "ipc-file"))
+			}
+		}
+		c.mutex.Unlock()
+	}
+
+	// the kernel closed the files that didn't fit, the files left can't be matched to their messages
+	if err == nil && flags&unix.MSG_CTRUNC != 0 {
+		err = errors.New("files received were truncated, more were sent with a message than can be received")
+	}
+
+	return n, err
+}
+
+// Close - closes the connection and any files received that no message claimed
+func (c *fileConn) Close() error {
+
+	c.mutex.Lock()
+	closeFiles(c.files)
+	c.files = nil
+	c.mutex.Unlock()
+
+	return c.UnixConn.Close()
+}
+
+// takeFiles - the files sent with the next message, data is the rest of the ctrlFiles control message
+func (sess *session) takeFiles(data []byte) []*os.File {
+
+	fc, ok := sess.conn.(*fileConn)
+	if !ok || len(data) == 0 {
+		return nil
+	}
+
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	n := int(data[0])
+	if n > len(fc.files) {
+		n = len(fc.files)
+	}
+
+	files := fc.files[:n:n]
+	fc.files = fc.files[n:]
+
+	return files
+}
+
+// sendFiles - writes the frames with the files attached to the first byte
+func (sess *session) sendFiles(b []byte, files []*os.File) error {
+
+	var uc *net.UnixConn
+
+	switch c := sess.conn.(type) {
+	case *fileConn:
+		uc = c.UnixConn
+	case *net.UnixConn:
+		uc = c
+	default:
+		return errors.New("the connection doesn't support passing files")
+	}
+
+	fds := make([]int, len(files))
+	for i, f := range files {
+		fds[i] = int(f.Fd())
+	}
+
+	n, _, err := uc.WriteMsgUnix(b, unix.UnixRights(fds...), nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = uc.Write(b[n:])
+
+	return err
+}
+
+// dupFiles - copies of the files, so they can be sent after the caller has closed the originals
+func dupFiles(files []*os.File) ([]*os.File, error) {
+
+	dups := make([]*os.File, 0, len(files))
+
+	for _, f := range files {
+
+		fd, err := unix.FcntlInt(f.Fd(), unix.F_DUPFD_CLOEXEC, 0)
+		if err != nil {
+			closeFiles(dups)
+			return nil, err
+		}
+
+		dups = append(dups, os.NewFile(uintptr(fd), f.Name()))
+	}
+
+	return dups, nil
+}
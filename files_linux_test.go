@@ -0,0 +1,54 @@
+package ipc
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestFilesTruncated(t *testing.T) {
+
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(t.TempDir(), "files.sock"), Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	sender, err := net.DialUnix("unix", nil, l.Addr().(*net.UnixAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	conn, err := l.AcceptUnix()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver := newFileConn(conn, false)
+	defer receiver.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	// more than fit in the space the receiver has for them
+	fds := make([]int, maxFiles+8)
+	for i := range fds {
+		fds[i] = int(r.Fd())
+	}
+
+	if _, _, err := sender.WriteMsgUnix([]byte{1}, unix.UnixRights(fds...), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := receiver.Read(make([]byte, 1)); err == nil {
+		t.Error("truncated files should be reported as an error")
+	}
+}
@@ -0,0 +1,35 @@
+//go:build !linux
+// +build !linux
+
+package ipc
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+func filesSupported(conn net.Conn) bool {
+
+	return false
+}
+
+func newFileConn(conn net.Conn, encrypted bool) net.Conn {
+
+	return conn
+}
+
+func (sess *session) takeFiles(data []byte) []*os.File {
+
+	return nil
+}
+
+func (sess *session) sendFiles(b []byte, files []*os.File) error {
+
+	return errors.New("the connection doesn't support passing files")
+}
+
+func dupFiles(files []*os.File) ([]*os.File, error) {
+
+	return nil, errors.New("passing files is only supported on linux")
+}
@@ -1,8 +1,13 @@
 module github.com/james-barrow/golang-ipc
 
-go 1.15
+go 1.18
 
 require (
 	github.com/Microsoft/go-winio v0.6.1
+	golang.org/x/sys v0.8.0
+)
+
+require (
+	golang.org/x/mod v0.10.0 // indirect
 	golang.org/x/tools v0.9.1 // indirect
 )
@@ -1,9 +1,12 @@
 package ipc
 
 import (
-	"bytes"
-	"encoding/binary"
+	"crypto/cipher"
 	"errors"
+	"io"
+	"net"
+
+	"github.com/james-barrow/golang-ipc/wire"
 )
 
 // 1st message sent from the server
@@ -28,21 +31,20 @@ func (sc *Server) handshake() error {
 		return err
 	}
 
+	if sc.peerCaps&capSharedMemory != 0 {
+		err = sc.sharedMemory()
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 
 }
 
 func (sc *Server) one() error {
 
-	buff := make([]byte, 2)
-
-	buff[0] = byte(version)
-
-	if sc.encryption {
-		buff[1] = byte(1)
-	} else {
-		buff[1] = byte(0)
-	}
+	buff, _ := wire.ServerHello{Version: version, Encryption: sc.encryption}.MarshalBinary()
 
 	_, err := sc.conn.Write(buff)
 	if err != nil {
@@ -56,13 +58,13 @@ func (sc *Server) one() error {
 	}
 
 	switch result := recv[0]; result {
-	case 0:
+	case wire.ReplyOK:
 		return nil
-	case 1:
+	case wire.ReplyVersion:
 		return errors.New("client has a different version number")
-	case 2:
+	case wire.ReplyEncryption:
 		return errors.New("client is enforcing encryption")
-	case 3:
+	case wire.ReplyFailed:
 		return errors.New("server failed to get handshake reply")
 
 	}
@@ -95,27 +97,17 @@ func (sc *Server) startEncryption() error {
 
 func (sc *Server) msgLength() error {
 
-	toSend := make([]byte, 4)
-
-	buff := make([]byte, 4)
-	binary.BigEndian.PutUint32(buff, uint32(sc.maxMsgSize))
-
+	var g cipher.AEAD
 	if sc.encryption {
-		maxMsg, err := encrypt(*sc.enc.cipher, buff)
-		if err != nil {
-			return err
-		}
-
-		binary.BigEndian.PutUint32(toSend, uint32(len(maxMsg)))
-		toSend = append(toSend, maxMsg...)
-
-	} else {
+		g = *sc.enc.cipher
+	}
 
-		binary.BigEndian.PutUint32(toSend, uint32(len(buff)))
-		toSend = append(toSend, buff...)
+	toSend, err := wire.AppendMaxMsgSize(nil, g, sc.maxMsgSize)
+	if err != nil {
+		return err
 	}
 
-	_, err := sc.conn.Write(toSend)
+	_, err = sc.conn.Write(toSend)
 	if err != nil {
 		return errors.New("unable to send max message length ")
 	}
@@ -127,6 +119,11 @@ func (sc *Server) msgLength() error {
 		return errors.New("did not received message length reply")
 	}
 
+	// read by WriteWithFiles() on other goroutines
+	sc.mutex.Lock()
+	sc.peerCaps = reply[0] // older clients always reply 0
+	sc.mutex.Unlock()
+
 	return nil
 
 }
@@ -151,35 +148,48 @@ func (cc *Client) handshake() error {
 		return err
 	}
 
+	if cc.shm {
+		err = cc.sharedMemory()
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 
 }
 
+// errServerBusy - the server didn't start the handshake in time, it only handles one client at a time so the client tries again
+var errServerBusy = errors.New("server is busy with another client")
+
 func (cc *Client) one() error {
 
 	recv := make([]byte, 2)
-	_, err := cc.conn.Read(recv)
+	_, err := io.ReadFull(cc.conn, recv)
 	if err != nil {
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			return errServerBusy
+		}
 		return errors.New("failed to received handshake message")
 	}
 
-	if recv[0] != version {
-		cc.handshakeSendReply(1)
+	var sh wire.ServerHello
+	sh.UnmarshalBinary(recv)
+
+	if sh.Version != version {
+		cc.handshakeSendReply(wire.ReplyVersion)
 		return errors.New("server has sent a different version number")
 	}
 
-	if recv[1] != 1 && cc.encryptionReq {
-		cc.handshakeSendReply(2)
+	if !sh.Encryption && cc.encryptionReq {
+		cc.handshakeSendReply(wire.ReplyEncryption)
 		return errors.New("server tried to connect without encryption")
 	}
 
-	if recv[1] == 0 {
-		cc.encryption = false
-	} else {
-		cc.encryption = true
-	}
+	cc.encryption = sh.Encryption
 
-	cc.handshakeSendReply(0) // 0 is ok
+	cc.handshakeSendReply(wire.ReplyOK)
 	return nil
 
 }
@@ -208,38 +218,30 @@ func (cc *Client) startEncryption() error {
 
 func (cc *Client) msgLength() error {
 
-	buff := make([]byte, 4)
+	var g cipher.AEAD
+	if cc.encryption {
+		g = *cc.enc.cipher
+	}
 
-	_, err := cc.conn.Read(buff)
+	maxMsgSize, err := wire.ReadMaxMsgSize(cc.conn, g)
 	if err != nil {
-		return errors.New("failed to received max message length 1")
+		return err
 	}
 
-	var msgLen uint32
-	binary.Read(bytes.NewReader(buff), binary.BigEndian, &msgLen) // message length
+	cc.mutex.Lock()
+	cc.maxMsgSize = maxMsgSize
+	cc.mutex.Unlock()
 
-	buff = make([]byte, int(msgLen))
-
-	_, err = cc.conn.Read(buff)
-	if err != nil {
-		return errors.New("failed to received max message length 2")
+	caps := byte(capHeaders | capChunks | capClientID)
+	if cc.shm {
+		caps |= capSharedMemory
 	}
-	var buff2 []byte
-	if cc.encryption {
-		buff2, err = decrypt(*cc.enc.cipher, buff)
-		if err != nil {
-			return errors.New("failed to received max message length 3")
-		}
 
-	} else {
-		buff2 = buff
+	if filesSupported(cc.conn) && !cc.encryption {
+		caps |= capFiles
 	}
 
-	var maxMsgSize uint32
-	binary.Read(bytes.NewReader(buff2), binary.BigEndian, &maxMsgSize) // message length
-
-	cc.maxMsgSize = int(maxMsgSize)
-	cc.handshakeSendReply(0)
+	cc.handshakeSendReply(caps)
 
 	return nil
 
@@ -1,11 +1,25 @@
 package ipc
 
 import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"net/http/httptest"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/james-barrow/golang-ipc/wire"
 )
 
 func TestStartUp_Name(t *testing.T) {
@@ -196,7 +210,9 @@ func TestWrite(t *testing.T) {
 		t.Error("There should be an error as the data we're attempting to write is bigger than the maxMsgSize")
 	}
 
+	sc.mutex.Lock()
 	sc.status = NotConnected
+	sc.mutex.Unlock()
 
 	buf2 := make([]byte, 5)
 	err5 := sc.Write(2, buf2)
@@ -204,7 +220,9 @@ func TestWrite(t *testing.T) {
 		t.Error("we should have an error becuse there is no connection")
 	}
 
+	sc.mutex.Lock()
 	sc.status = Connected
+	sc.mutex.Unlock()
 
 	buf = make([]byte, 1)
 
@@ -219,7 +237,9 @@ func TestWrite(t *testing.T) {
 		t.Error("There should be an error is the data we're attempting to write is bigger than the maxMsgSize")
 	}
 
+	cc.mutex.Lock()
 	cc.status = NotConnected
+	cc.mutex.Unlock()
 
 	buf = make([]byte, 5)
 	err = cc.Write(2, buf)
@@ -276,7 +296,6 @@ func TestRead(t *testing.T) {
 	cIPC := &Client{
 		Name:       "test",
 		timeout:    2,
-		retryTimer: 1,
 		status:     NotConnected,
 		received:   make(chan *Message),
 	}
@@ -866,7 +885,7 @@ func TestEncryptionFunctions(t *testing.T) {
 
 	buff := make([]byte, 0)
 
-	if bytesToPublicKey(buff) != nil {
+	if _, err := wire.UnmarshalPublicKey(buff); err == nil {
 		t.Error("should have failed as buff is 0 bytes")
 	}
 
@@ -1578,3 +1597,2393 @@ func TestServerWrongVersionNumber(t *testing.T) {
 }
 
 */
+
+func TestEvents(t *testing.T) {
+
+	sc, err := StartServer("test_events", &ServerConfig{Encryption: true, SuppressStatus: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	time.Sleep(time.Second / 4)
+
+	cc, err2 := StartClient("test_events", &ClientConfig{Encryption: true, SuppressStatus: true})
+	if err2 != nil {
+		t.Error(err2)
+	}
+
+	for {
+		e := <-cc.Events()
+		if e.Err != nil {
+			t.Fatal(e.Err)
+		}
+
+		if e.Status == Connected {
+			if e.OldStatus != Connecting {
+				t.Error("client should have moved from connecting to connected")
+			}
+			if e.Peer == nil || !e.Peer.Encryption || e.Peer.MaxMsgSize != maxMsgSize {
+				t.Error("client connected event should have the peer details")
+			}
+			break
+		}
+	}
+
+	for {
+		e := <-sc.Events()
+		if e.Status == Connected {
+			break
+		}
+	}
+
+	cc.Write(5, []byte("message"))
+
+	m, err := sc.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.MsgType != 5 || string(m.Data) != "message" {
+		t.Error("status messages should have been suppressed, only the data message should be read")
+	}
+
+	cc.Close()
+	sc.Close()
+}
+
+type countMetrics struct {
+	sent     int
+	received int
+}
+
+func (cm *countMetrics) MessageSent(msgType int, bytes int)     { cm.sent++ }
+func (cm *countMetrics) MessageReceived(msgType int, bytes int) { cm.received++ }
+func (cm *countMetrics) MessageDropped(msgType int)             {}
+func (cm *countMetrics) MessageExpired(msgType int)             {}
+func (cm *countMetrics) EncryptionError()                       {}
+func (cm *countMetrics) DecryptionError()                       {}
+func (cm *countMetrics) Handshake(duration time.Duration)       {}
+func (cm *countMetrics) ReconnectAttempt()                      {}
+
+func TestStats(t *testing.T) {
+
+	hook := &countMetrics{}
+
+	sc, err := StartServer("test_stats", &ServerConfig{Encryption: true, SuppressStatus: true, Metrics: hook})
+	if err != nil {
+		t.Error(err)
+	}
+
+	time.Sleep(time.Second / 4)
+
+	cc, err2 := StartClient("test_stats", &ClientConfig{Encryption: true, SuppressStatus: true})
+	if err2 != nil {
+		t.Error(err2)
+	}
+
+	for e := range cc.Events() {
+		if e.Status == Connected {
+			break
+		}
+	}
+
+	cc.Write(5, []byte("hello"))
+	cc.Write(6, []byte("hello again"))
+
+	sc.Read()
+	sc.Read()
+
+	ss := sc.Stats()
+	if ss.Received[5].Messages != 1 || ss.Received[5].Bytes != 5 || ss.Received[6].Bytes != 11 {
+		t.Error("server stats should have counted the messages received", ss.Received)
+	}
+
+	if ss.Handshakes != 1 {
+		t.Error("server should have completed one handshake")
+	}
+
+	if hook.received != 2 {
+		t.Error("metrics hook should have been called for each message received")
+	}
+
+	if cs := cc.Stats(); cs.Sent[5].Messages != 1 || cs.Sent[6].Messages != 1 {
+		t.Error("client stats should have counted the messages sent", cs.Sent)
+	}
+
+	rec := httptest.NewRecorder()
+	PrometheusHandler(map[string]StatsProvider{"test_stats": sc}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if !strings.Contains(rec.Body.String(), `ipc_bytes_received_total{ipc="test_stats",msg_type="6"} 11`) {
+		t.Error("prometheus output is missing the bytes received", rec.Body.String())
+	}
+
+	var buf bytes.Buffer
+	writePrometheus(&buf, []string{"a\"b\\c\nd\u00e9\x01"}, []Stats{{}})
+
+	if !strings.Contains(buf.String(), "ipc_write_queue_depth{ipc=\"a\\\"b\\\\c\\nd\u00e9\x01\"} 0") {
+		t.Error("only backslash, double quote and newline should be escaped in label values", buf.String())
+	}
+
+	cc.Close()
+	sc.Close()
+}
+
+// recordHook - a Recorder that keeps what it's given
+type recordHook struct {
+	mutex    sync.Mutex
+	sent     []string
+	received []string
+	statuses []Status
+}
+
+func (r *recordHook) RecordSent(m *Message) {
+	r.mutex.Lock()
+	r.sent = append(r.sent, string(m.Data))
+	r.mutex.Unlock()
+}
+
+func (r *recordHook) RecordReceived(m *Message) {
+	r.mutex.Lock()
+	r.received = append(r.received, string(m.Data))
+	r.mutex.Unlock()
+}
+
+func (r *recordHook) RecordEvent(e Event) {
+	r.mutex.Lock()
+	if e.Err == nil {
+		r.statuses = append(r.statuses, e.Status)
+	}
+	r.mutex.Unlock()
+}
+
+func TestRecorder(t *testing.T) {
+
+	hook := &recordHook{}
+
+	sc, err := StartServer("test_recorder", &ServerConfig{Encryption: true, SuppressStatus: true, Recorder: hook})
+	if err != nil {
+		t.Error(err)
+	}
+
+	time.Sleep(time.Second / 4)
+
+	cc, err2 := StartClient("test_recorder", &ClientConfig{Encryption: true, SuppressStatus: true})
+	if err2 != nil {
+		t.Error(err2)
+	}
+
+	for e := range cc.Events() {
+		if e.Status == Connected {
+			break
+		}
+	}
+
+	cc.Write(5, []byte("hello"))
+	sc.Read()
+
+	sc.Write(6, []byte("reply"))
+	cc.Read()
+
+	// the message is recorded once it has been flushed, which can be after the client has read it
+	for i := 0; i < 100; i++ {
+		hook.mutex.Lock()
+		n := len(hook.sent)
+		hook.mutex.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	hook.mutex.Lock()
+
+	if len(hook.received) != 1 || hook.received[0] != "hello" {
+		t.Error("recorder should have seen the message received", hook.received)
+	}
+
+	if len(hook.sent) != 1 || hook.sent[0] != "reply" {
+		t.Error("recorder should have seen the message sent", hook.sent)
+	}
+
+	if len(hook.statuses) < 2 || hook.statuses[0] != Listening || hook.statuses[len(hook.statuses)-1] != Connected {
+		t.Error("recorder should have seen the status changes", hook.statuses)
+	}
+
+	hook.mutex.Unlock()
+
+	cc.Close()
+	sc.Close()
+}
+
+func TestTraceContext(t *testing.T) {
+
+	sc, err := StartServer("test_trace", &ServerConfig{Encryption: true, SuppressStatus: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	time.Sleep(time.Second / 4)
+
+	cc, err2 := StartClient("test_trace", &ClientConfig{Encryption: true, SuppressStatus: true})
+	if err2 != nil {
+		t.Error(err2)
+	}
+
+	for e := range cc.Events() {
+		if e.Status == Connected {
+			break
+		}
+	}
+
+	parent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	err = cc.WriteContext(ContextWithTrace(context.Background(), "not a traceparent", ""), 5, []byte("bad"))
+	if err == nil {
+		t.Error("should have failed as the traceparent isn't valid")
+	}
+
+	cc.WriteContext(ContextWithTrace(context.Background(), parent, "congo=t61rcWkgMzE"), 5, []byte("traced"))
+	cc.Write(5, []byte("untraced"))
+
+	m, err := sc.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.TraceParent != parent || m.TraceState != "congo=t61rcWkgMzE" {
+		t.Error("trace context should have been received with the message", m.TraceParent, m.TraceState)
+	}
+
+	if p, _ := TraceFromContext(m.Context()); p != parent {
+		t.Error("trace context should have been extracted into the message context")
+	}
+
+	m, err = sc.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(m.Data) != "untraced" || m.TraceParent != "" {
+		t.Error("trace context should only apply to the message it was sent with")
+	}
+
+	cc.Close()
+	sc.Close()
+}
+
+func TestHeadersEncoding(t *testing.T) {
+
+	headers := map[string]string{"a": "1", "key": "", "": "value"}
+
+	got, err := wire.DecodeHeaders(wire.EncodeHeaders(headers))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 3 || got["a"] != "1" || got[""] != "value" {
+		t.Error("headers should be the same after decoding", got)
+	}
+
+	if _, err := wire.DecodeHeaders([]byte{0, 2, 0, 1, 'a'}); err == nil {
+		t.Error("should have failed as the headers are truncated")
+	}
+}
+
+func TestHeaders(t *testing.T) {
+
+	sc, err := StartServer("test_headers", &ServerConfig{Encryption: true, SuppressStatus: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	time.Sleep(time.Second / 4)
+
+	cc, err2 := StartClient("test_headers", &ClientConfig{Encryption: true, SuppressStatus: true})
+	if err2 != nil {
+		t.Error(err2)
+	}
+
+	for e := range sc.Events() {
+		if e.Status == Connected {
+			break
+		}
+	}
+
+	cc.WriteMessage(&Message{MsgType: 5, Data: []byte("to server"), Headers: map[string]string{HeaderCorrelationID: "1234"}})
+
+	m, err := sc.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Headers[HeaderCorrelationID] != "1234" {
+		t.Error("server should have received the headers", m.Headers)
+	}
+
+	sc.WriteMessage(&Message{MsgType: 6, Data: []byte("to client"), Headers: map[string]string{HeaderContentType: "text/plain"}})
+
+	m, err = cc.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.MsgType != 6 || m.Headers[HeaderContentType] != "text/plain" {
+		t.Error("client should have received the headers", m.Headers)
+	}
+
+	cc.Close()
+	sc.Close()
+}
+
+// a client from before headers were added replies 0 to the max message length, the server shouldn't send it headers
+func TestHeadersOldClient(t *testing.T) {
+
+	sc, err := StartServer("test_headers_old", &ServerConfig{Encryption: false, SuppressStatus: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	time.Sleep(time.Second / 4)
+
+	conn, err := net.Dial("unix", "/tmp/test_headers_old.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	buff := make([]byte, 8)
+
+	conn.Read(buff[:2])  // version and encryption
+	conn.Write([]byte{0}) // ok
+	conn.Read(buff[:8])  // max message length
+	conn.Write([]byte{0}) // old clients always reply 0
+
+	for e := range sc.Events() {
+		if e.Status == Connected {
+			break
+		}
+	}
+
+	sc.WriteMessage(&Message{MsgType: 5, Data: []byte("hello"), Headers: map[string]string{HeaderSender: "server"}})
+
+	conn.Read(buff[:8])
+
+	if msgType, _, _ := wire.SplitFrame(buff[4:8]); msgType != 5 {
+		t.Error("the first message should be the data and not a control message")
+	}
+
+	sc.Close()
+}
+
+func TestClientShutdown(t *testing.T) {
+
+	sc, err := StartServer("test_shutdown", nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	time.Sleep(time.Second / 4)
+
+	cc, err2 := StartClient("test_shutdown", &ClientConfig{Encryption: true, SuppressStatus: true})
+	if err2 != nil {
+		t.Error(err2)
+	}
+
+	for e := range cc.Events() {
+		if e.Status == Connected {
+			break
+		}
+	}
+
+	cc.Write(5, []byte("one"))
+	cc.Write(5, []byte("two"))
+
+	shutdown := make(chan error, 1)
+
+	go func() {
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		shutdown <- cc.Shutdown(ctx)
+	}()
+
+	received := 0
+
+	for {
+		m, err := sc.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if m.MsgType == 5 {
+			received++
+		}
+
+		if m.Status == "Disconnected" {
+			break
+		}
+	}
+
+	if received != 2 {
+		t.Error("messages queued before the shutdown should have been sent")
+	}
+
+	// nothing is reading the client, shutdown mustn't wait for it to
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Error("shutdown should finish without anything calling Read", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("shutdown should finish promptly without anything calling Read")
+	}
+
+	if _, err := cc.Read(); err == nil || err.Error() != "client has closed the connection" {
+		t.Error("client read should return an error after shutdown", err)
+	}
+
+	if err := cc.Write(5, []byte("three")); err == nil {
+		t.Error("write should fail after shutdown")
+	}
+
+	sc.Close()
+}
+
+func TestServerShutdown(t *testing.T) {
+
+	sc, err := StartServer("test_shutdown2", &ServerConfig{Encryption: true, SuppressStatus: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	time.Sleep(time.Second / 4)
+
+	cc, err2 := StartClient("test_shutdown2", &ClientConfig{Encryption: true, SuppressStatus: true})
+	if err2 != nil {
+		t.Error(err2)
+	}
+
+	for e := range sc.Events() {
+		if e.Status == Connected {
+			break
+		}
+	}
+
+	sc.Write(5, []byte("last message"))
+
+	shutdown := make(chan error, 1)
+
+	go func() {
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		shutdown <- sc.Shutdown(ctx)
+	}()
+
+	m, err := cc.Read()
+	if err != nil || m.MsgType != 5 {
+		t.Error("message queued before the shutdown should have been sent")
+	}
+
+	for e := range cc.Events() {
+
+		if e.Status == ReConnecting {
+			t.Fatal("client shouldn't reconnect after a graceful shutdown")
+		}
+
+		if e.Status == Disconnected {
+			break
+		}
+	}
+
+	// nothing is reading the server, shutdown mustn't wait for it to
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Error("shutdown should finish without anything calling Read", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("shutdown should finish promptly without anything calling Read")
+	}
+
+	if _, err := sc.Read(); err == nil || err.Error() != "server has closed the connection" {
+		t.Error("server read should return an error after shutdown", err)
+	}
+
+	if sc.StatusCode() != Closed {
+		t.Error("server should be closed after shutdown", sc.Status())
+	}
+
+	if _, err := os.Stat("/tmp/test_shutdown2.sock"); !os.IsNotExist(err) {
+		t.Error("socket file should have been removed")
+	}
+}
+
+func TestShutdownUnread(t *testing.T) {
+
+	sc, err := StartServer("test_shutdown_unread", &ServerConfig{Encryption: true, SuppressStatus: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := StartClient("test_shutdown_unread", &ClientConfig{Encryption: true, SuppressStatus: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := sc.WaitForStatus(ctx, Connected); err != nil {
+		t.Fatal(err)
+	}
+
+	cc.Write(5, []byte("never read by the server"))
+	sc.Write(5, []byte("never read by the client"))
+
+	time.Sleep(time.Second / 4)
+
+	// with status messages on, nothing reads the Listening and Connecting statuses either
+	sc2, err := StartServer("test_shutdown_unread2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc2, err := StartClient("test_shutdown_unread2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, shutdown := range []func(context.Context) error{sc.Shutdown, cc.Shutdown, sc2.Shutdown, cc2.Shutdown} {
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		err := shutdown(ctx)
+		cancel()
+
+		if err != nil {
+			t.Fatal("shutdown shouldn't wait for anything to be read", err)
+		}
+	}
+
+	for _, status := range []Status{sc.StatusCode(), cc.StatusCode(), sc2.StatusCode(), cc2.StatusCode()} {
+		if status != Closed {
+			t.Error("everything should be closed", status.String())
+		}
+	}
+}
+
+func TestCloseIdle(t *testing.T) {
+
+	sc, err := StartServer("test_close_idle", &ServerConfig{Encryption: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// no client has connected, so there's no read goroutine to end Read()
+	sc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := sc.WaitForStatus(ctx, Closed); err != nil {
+		t.Fatal("server should be closed", sc.Status())
+	}
+
+	if m, err := sc.Read(); err != nil || m.Status != "Closed" {
+		t.Error("expected the closed status", m, err)
+	}
+
+	if _, err := sc.Read(); err == nil {
+		t.Error("read should return an error once the server is closed")
+	}
+
+	// a client that has disconnected and won't reconnect
+	sc2, err := StartServer("test_close_idle2", &ServerConfig{Encryption: true, SuppressStatus: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := StartClient("test_close_idle2", &ClientConfig{Encryption: true, SuppressStatus: true, DisableReconnect: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cc.WaitForStatus(ctx, Connected); err != nil {
+		t.Fatal(err)
+	}
+
+	sc2.Close()
+
+	if err := cc.WaitForStatus(ctx, Disconnected); err != nil {
+		t.Fatal(err)
+	}
+
+	cc.Close()
+
+	if err := cc.WaitForStatus(ctx, Closed); err != nil {
+		t.Fatal("client should be closed", cc.Status())
+	}
+
+	if _, err := cc.Read(); err == nil {
+		t.Error("read should return an error once the client is closed")
+	}
+}
+
+func TestStatusTransitions(t *testing.T) {
+
+	if !legalTransition(Connected, ReConnecting) || !legalTransition(Closing, Closed) {
+		t.Error("should be able to reconnect and close")
+	}
+
+	if legalTransition(Closing, Connected) || legalTransition(Closed, Connected) {
+		t.Error("shouldn't be able to connect once the connection is closing")
+	}
+
+	sc := &Server{status: Connected}
+
+	if !sc.setStatus(Closing) {
+		t.Error("should be able to close a connected server")
+	}
+
+	if sc.setStatus(Connected) || sc.StatusCode() != Closing {
+		t.Error("status should stay as closing")
+	}
+}
+
+func TestWaitForStatus(t *testing.T) {
+
+	sc, err := StartServer("test_wait", &ServerConfig{Encryption: true, SuppressStatus: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	cc, err2 := StartClient("test_wait", &ClientConfig{Encryption: true, SuppressStatus: true})
+	if err2 != nil {
+		t.Error(err2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := cc.WaitForStatus(ctx, Connected); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sc.WaitForStatus(ctx, Connected); err != nil {
+		t.Fatal(err)
+	}
+
+	short, cancel2 := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel2()
+
+	if err := cc.WaitForStatus(short, Timeout); err != context.DeadlineExceeded {
+		t.Error("should have timed out waiting for a status that doesn't happen")
+	}
+
+	cc.Close()
+	sc.Close()
+}
+
+func TestWritePolicy(t *testing.T) {
+
+	st := newStats()
+
+	toWrite := make(chan *Message, 2)
+
+	enqueue(toWrite, &Message{MsgType: 1}, WriteFailFast, st)
+	enqueue(toWrite, &Message{MsgType: 2}, WriteFailFast, st)
+
+	if err := enqueue(toWrite, &Message{MsgType: 3}, WriteFailFast, st); err != ErrQueueFull {
+		t.Error("should have returned ErrQueueFull as the buffer is full")
+	}
+
+	if err := enqueue(toWrite, &Message{MsgType: 3}, WriteDropOldest, st); err != nil {
+		t.Error(err)
+	}
+
+	if m := <-toWrite; m.MsgType != 2 {
+		t.Error("the oldest message should have been dropped")
+	}
+
+	if m := <-toWrite; m.MsgType != 3 {
+		t.Error("the new message should have been queued")
+	}
+
+	if st.snapshot().Dropped != 1 {
+		t.Error("the dropped message should have been counted")
+	}
+
+	blocked := make(chan error, 1)
+
+	enqueue(toWrite, &Message{MsgType: 4}, WriteBlock, st)
+	enqueue(toWrite, &Message{MsgType: 5}, WriteBlock, st)
+
+	go func() {
+		blocked <- enqueue(toWrite, &Message{MsgType: 6}, WriteBlock, st)
+	}()
+
+	select {
+	case <-blocked:
+		t.Error("write should block while the buffer is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	<-toWrite
+
+	if err := <-blocked; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTryWrite(t *testing.T) {
+
+	sc, err := StartServer("test_trywrite", &ServerConfig{Encryption: true, SuppressStatus: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	cc, err2 := StartClient("test_trywrite", &ClientConfig{Encryption: true, SuppressStatus: true, WriteBuffer: 10})
+	if err2 != nil {
+		t.Error(err2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cc.WaitForStatus(ctx, Connected)
+
+	for i := 0; i < 5; i++ {
+		if err := cc.TryWrite(5, []byte("buffered")); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		m, err := sc.Read()
+		if err != nil || m.MsgType != 5 {
+			t.Error("should have received all the buffered messages", err)
+		}
+	}
+
+	cc.Close()
+	sc.Close()
+}
+
+func TestWriteBatch(t *testing.T) {
+
+	sc, err := StartServer("test_writebatch", &ServerConfig{Encryption: true, SuppressStatus: true, MaxBatch: 4, BatchLatency: 5 * time.Millisecond})
+	if err != nil {
+		t.Error(err)
+	}
+
+	cc, err2 := StartClient("test_writebatch", &ClientConfig{Encryption: true, SuppressStatus: true, WriteBuffer: 20})
+	if err2 != nil {
+		t.Error(err2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sc.WaitForStatus(ctx, Connected)
+	cc.WaitForStatus(ctx, Connected)
+
+	err = cc.WriteBatch([]Message{{MsgType: 5, Data: []byte("one")}, {MsgType: 0, Data: []byte("reserved")}})
+	if err == nil {
+		t.Error("batch containing message type 0 should have been rejected")
+	}
+
+	batch := []Message{
+		{MsgType: 5, Data: []byte("one")},
+		{MsgType: 6, Data: []byte("two"), Headers: map[string]string{HeaderCorrelationID: "abc"}},
+		{MsgType: 7, Data: []byte("three")},
+	}
+
+	if err := cc.WriteBatch(batch); err != nil {
+		t.Error(err)
+	}
+
+	for i := range batch {
+		m, err := sc.Read()
+		if err != nil {
+			t.Error(err)
+			break
+		}
+		if m.MsgType != batch[i].MsgType || string(m.Data) != string(batch[i].Data) {
+			t.Error("batched messages should arrive in order", m.MsgType, string(m.Data))
+		}
+		if i == 1 && m.Headers[HeaderCorrelationID] != "abc" {
+			t.Error("headers should be sent with batched messages")
+		}
+	}
+
+	// more messages than MaxBatch are written across several flushes
+	for i := 0; i < 10; i++ {
+		if err := sc.Write(5, []byte{byte(i)}); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		m, err := cc.Read()
+		if err != nil || m.MsgType != 5 || m.Data[0] != byte(i) {
+			t.Error("coalesced messages should arrive in order", err)
+		}
+	}
+
+	cc.Close()
+	sc.Close()
+}
+
+func TestFrameInPlace(t *testing.T) {
+
+	g, err := createCipher([32]byte{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []cipher.AEAD{nil, *g} {
+
+		b, err := wire.AppendFrame(make([]byte, 0, 8), c, 7, []byte("in place"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if l, err := wire.FrameLength(b[:4], 1024); err != nil || l != len(b)-4 {
+			t.Error("frame length should cover the rest of the frame")
+		}
+
+		body := b[4:]
+		if c != nil {
+			body, err = wire.OpenFrame(c, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if msgType, data, err := wire.SplitFrame(body); err != nil || msgType != 7 || string(data) != "in place" {
+			t.Error("frame should decode to the message type and data", body)
+		}
+	}
+}
+
+func TestRelease(t *testing.T) {
+
+	sc, err := StartServer("test_release", &ServerConfig{Encryption: true, SuppressStatus: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	cc, err2 := StartClient("test_release", &ClientConfig{Encryption: true, SuppressStatus: true})
+	if err2 != nil {
+		t.Error(err2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cc.WaitForStatus(ctx, Connected)
+
+	for i := 0; i < 20; i++ {
+
+		msg := []byte(fmt.Sprintf("message %d", i))
+
+		if err := cc.Write(5, msg); err != nil {
+			t.Error(err)
+		}
+
+		m, err := sc.Read()
+		if err != nil {
+			t.Error(err)
+			break
+		}
+
+		if string(m.Data) != string(msg) {
+			t.Error("a reused buffer should hold the new message", string(m.Data))
+		}
+
+		m.Release()
+		m.Release()
+
+		if m.Data != nil {
+			t.Error("Data should be nil after Release()")
+		}
+	}
+
+	cc.Close()
+	sc.Close()
+}
+
+func benchmarkReadWrite(b *testing.B, name string, encryption bool, size int, shm int) {
+
+	sc, err := StartServer(name, &ServerConfig{Encryption: encryption, SuppressStatus: true, SharedMemory: shm})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	cc, err := StartClient(name, &ClientConfig{Encryption: encryption, SuppressStatus: true, WriteBuffer: 64, SharedMemory: shm > 0})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := cc.WaitForStatus(ctx, Connected); err != nil {
+		b.Fatal(err)
+	}
+
+	data := make([]byte, size)
+
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	go func() {
+		for i := 0; i < b.N; i++ {
+			cc.Write(5, data)
+		}
+	}()
+
+	for i := 0; i < b.N; i++ {
+		m, err := sc.Read()
+		if err != nil {
+			b.Fatal(err)
+		}
+		m.Release()
+	}
+
+	b.StopTimer()
+
+	cc.Close()
+	sc.Close()
+}
+
+func BenchmarkPlaintext64(b *testing.B) {
+	benchmarkReadWrite(b, "bench_plain_64", false, 64, 0)
+}
+
+func BenchmarkPlaintext4K(b *testing.B) {
+	benchmarkReadWrite(b, "bench_plain_4k", false, 4096, 0)
+}
+
+func BenchmarkEncrypted64(b *testing.B) {
+	benchmarkReadWrite(b, "bench_enc_64", true, 64, 0)
+}
+
+func BenchmarkEncrypted4K(b *testing.B) {
+	benchmarkReadWrite(b, "bench_enc_4k", true, 4096, 0)
+}
+
+func BenchmarkSharedMemory4K(b *testing.B) {
+
+	if runtime.GOOS != "linux" {
+		b.Skip("shared memory is only supported on linux")
+	}
+
+	benchmarkReadWrite(b, "bench_shm_4k", false, 4096, 1<<20)
+}
+
+func TestSharedMemory(t *testing.T) {
+
+	if runtime.GOOS != "linux" {
+		t.Skip("shared memory is only supported on linux")
+	}
+
+	// a ring smaller than the messages, so writes wrap around and wait for space
+	sc, err := StartServer("test_shm", &ServerConfig{Encryption: true, SuppressStatus: true, SharedMemory: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err2 := StartClient("test_shm", &ClientConfig{Encryption: true, SuppressStatus: true, SharedMemory: true})
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sc.WaitForStatus(ctx, Connected)
+	cc.WaitForStatus(ctx, Connected)
+
+	sc.mutex.Lock()
+	transport := fmt.Sprintf("%T", sc.conn)
+	sc.mutex.Unlock()
+
+	if transport != "*ipc.shmConn" {
+		t.Error("the server should be using shared memory, not", transport)
+	}
+
+	msg := func(i int) []byte {
+		return []byte(strings.Repeat(fmt.Sprintf("message %d ", i), 1000))
+	}
+
+	go func() {
+		for i := 0; i < 50; i++ {
+			cc.Write(5, msg(i))
+		}
+	}()
+
+	go func() {
+		for i := 0; i < 50; i++ {
+			sc.Write(6, msg(i))
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		m, err := sc.Read()
+		if err != nil || m.MsgType != 5 || string(m.Data) != string(msg(i)) {
+			t.Fatal("server should receive every message intact and in order", i, err)
+		}
+
+		m, err = cc.Read()
+		if err != nil || m.MsgType != 6 || string(m.Data) != string(msg(i)) {
+			t.Fatal("client should receive every message intact and in order", i, err)
+		}
+	}
+
+	cc.Close()
+	sc.Close()
+}
+
+func TestSharedMemoryNotOffered(t *testing.T) {
+
+	if runtime.GOOS != "linux" {
+		t.Skip("shared memory is only supported on linux")
+	}
+
+	sc, err := StartServer("test_shm_off", &ServerConfig{Encryption: false, SuppressStatus: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err2 := StartClient("test_shm_off", &ClientConfig{Encryption: false, SuppressStatus: true, SharedMemory: true})
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cc.WaitForStatus(ctx, Connected)
+
+	if err := cc.Write(5, []byte("over the socket")); err != nil {
+		t.Error(err)
+	}
+
+	m, err := sc.Read()
+	if err != nil || string(m.Data) != "over the socket" {
+		t.Error("a server without shared memory should carry on using the socket", err)
+	}
+
+	cc.Close()
+	sc.Close()
+}
+
+func TestWriteWithFiles(t *testing.T) {
+
+	if runtime.GOOS != "linux" {
+		t.Skip("passing files is only supported on linux")
+	}
+
+	sc, err := StartServer("test_files", &ServerConfig{Encryption: false, SuppressStatus: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err2 := StartClient("test_files", &ClientConfig{Encryption: false, SuppressStatus: true})
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sc.WaitForStatus(ctx, Connected)
+	cc.WaitForStatus(ctx, Connected)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cc.WriteWithFiles(5, []byte("pipe"), []*os.File{r, w}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the files are copied, so the originals can be closed straight away
+	r.Close()
+	w.Close()
+
+	m, err := sc.Read()
+	if err != nil || string(m.Data) != "pipe" || len(m.Files) != 2 {
+		t.Fatal("server should receive the message with both files", err)
+	}
+
+	go m.Files[1].Write([]byte("through the pipe"))
+
+	buff := make([]byte, 16)
+	if _, err := io.ReadFull(m.Files[0], buff); err != nil || string(buff) != "through the pipe" {
+		t.Error("the received files should be the two ends of the pipe", err)
+	}
+
+	closeFiles(m.Files)
+
+	f, err := ioutil.TempFile("", "ipc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString("from the server")
+	f.Seek(0, 0)
+
+	if err := sc.WriteWithFiles(6, []byte("file"), []*os.File{f}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// messages without files either side still arrive in order
+	sc.Write(7, []byte("after"))
+
+	m, err = cc.Read()
+	if err != nil || m.MsgType != 6 || len(m.Files) != 1 {
+		t.Fatal("client should receive the message with the file", err)
+	}
+
+	b, _ := ioutil.ReadAll(m.Files[0])
+	if string(b) != "from the server" {
+		t.Error("the received file should have the same contents", string(b))
+	}
+	closeFiles(m.Files)
+
+	m, err = cc.Read()
+	if err != nil || m.MsgType != 7 || m.Files != nil {
+		t.Error("the next message shouldn't have any files", err)
+	}
+
+	cc.Close()
+	sc.Close()
+}
+
+func TestWriteWithFilesEncrypted(t *testing.T) {
+
+	sc, err := StartServer("test_files_enc", &ServerConfig{Encryption: true, SuppressStatus: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err2 := StartClient("test_files_enc", &ClientConfig{Encryption: true, SuppressStatus: true})
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sc.WaitForStatus(ctx, Connected)
+	cc.WaitForStatus(ctx, Connected)
+
+	err = cc.WriteWithFiles(5, []byte("file"), []*os.File{os.Stdin})
+	if err == nil {
+		t.Error("files shouldn't be sent over an encrypted connection")
+	}
+
+	err = sc.WriteWithFiles(5, []byte("file"), []*os.File{os.Stdin})
+	if err == nil {
+		t.Error("files shouldn't be sent over an encrypted connection")
+	}
+
+	cc.Close()
+	sc.Close()
+}
+
+// tapTransport - unix sockets in a directory, keeping a copy of everything the client reads and writes so the frames can be checked
+type tapTransport struct {
+	dir string
+
+	mutex   sync.Mutex
+	read    bytes.Buffer
+	written bytes.Buffer
+}
+
+func (tt *tapTransport) Listen(name string) (net.Listener, error) {
+
+	return net.Listen("unix", filepath.Join(tt.dir, name))
+}
+
+func (tt *tapTransport) Dial(name string) (net.Conn, error) {
+
+	conn, err := net.Dial("unix", filepath.Join(tt.dir, name))
+	if err != nil {
+		return nil, err
+	}
+
+	return &tapConn{Conn: conn, tt: tt}, nil
+}
+
+// chunks - the number of chunk frames the client has read and written, g is the connection's cipher or nil
+func (tt *tapTransport) chunks(t *testing.T, g cipher.AEAD) (read int, written int) {
+
+	tt.mutex.Lock()
+	defer tt.mutex.Unlock()
+
+	// the server's hello and public key come before the max message length, after that everything is a frame
+	skip := 2
+	if g != nil {
+		skip += wire.PublicKeySize
+	}
+
+	r := bytes.NewReader(tt.read.Bytes()[skip:])
+
+	max, err := wire.ReadMaxMsgSize(r, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the client's replies to the hello and max message length, with its public key between them
+	skip = 2
+	if g != nil {
+		skip += wire.PublicKeySize
+	}
+
+	return countChunks(r, g, max), countChunks(bytes.NewReader(tt.written.Bytes()[skip:]), g, max)
+}
+
+func countChunks(r io.Reader, g cipher.AEAD, max int) int {
+
+	n := 0
+	dec := wire.NewDecoder(r, g, max)
+
+	for {
+		f, err := dec.Decode()
+		if err != nil {
+			return n
+		}
+
+		if f.MsgType == 0 && len(f.Data) > 0 && f.Data[0] == ctrlChunk {
+			n++
+		}
+	}
+}
+
+type tapConn struct {
+	net.Conn
+	tt *tapTransport
+}
+
+func (c *tapConn) Read(b []byte) (int, error) {
+
+	n, err := c.Conn.Read(b)
+
+	c.tt.mutex.Lock()
+	c.tt.read.Write(b[:n])
+	c.tt.mutex.Unlock()
+
+	return n, err
+}
+
+func (c *tapConn) Write(b []byte) (int, error) {
+
+	n, err := c.Conn.Write(b)
+
+	c.tt.mutex.Lock()
+	c.tt.written.Write(b[:n])
+	c.tt.mutex.Unlock()
+
+	return n, err
+}
+
+func TestPriority(t *testing.T) {
+
+	tap := &tapTransport{dir: t.TempDir()}
+
+	sc, err := StartServer("test_priority", &ServerConfig{Encryption: true, SuppressStatus: true, WriteBuffer: 32, Transport: tap})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err2 := StartClient("test_priority", &ClientConfig{Encryption: true, SuppressStatus: true, Transport: tap})
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sc.WaitForStatus(ctx, Connected)
+	cc.WaitForStatus(ctx, Connected)
+
+	// the client isn't reading yet, so the socket fills up part way through the first few messages
+	bulk := make([]byte, 1<<20)
+	for i := 0; i < 20; i++ {
+		bulk[0] = byte(i)
+		if err := sc.WritePriority(PriorityLow, 5, append([]byte(nil), bulk...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = sc.WriteMessage(&Message{MsgType: 6, Data: []byte("stop"), Priority: PriorityHigh, Headers: map[string]string{HeaderCorrelationID: "urgent"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	urgent := -1
+
+	for i := 0; i < 21; i++ {
+		m, err := cc.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if m.MsgType == 6 {
+			urgent = i
+			if m.Headers[HeaderCorrelationID] != "urgent" {
+				t.Error("the urgent message should keep its headers")
+			}
+			continue
+		}
+
+		if len(m.Data) != len(bulk) {
+			t.Fatal("chunked message should arrive whole", len(m.Data))
+		}
+
+		if int(m.Data[0]) != i && int(m.Data[0]) != i-1 {
+			t.Error("messages of the same priority should arrive in order", m.Data[0], i)
+		}
+	}
+
+	if urgent < 0 || urgent > 5 {
+		t.Error("the high priority message should overtake the queued low priority ones, it arrived at", urgent)
+	}
+
+	if read, _ := tap.chunks(t, *sc.enc.cipher); read == 0 {
+		t.Error("the low priority messages should have been sent to the client in chunks")
+	}
+
+	cc.Close()
+	sc.Close()
+}
+
+func TestChunkedHeaders(t *testing.T) {
+
+	tap := &tapTransport{dir: t.TempDir()}
+
+	sc, err := StartServer("test_chunks", &ServerConfig{Encryption: false, SuppressStatus: true, Transport: tap})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err2 := StartClient("test_chunks", &ClientConfig{Encryption: false, SuppressStatus: true, Transport: tap})
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sc.WaitForStatus(ctx, Connected)
+	cc.WaitForStatus(ctx, Connected)
+
+	data := []byte(strings.Repeat("chunk", chunkSize))
+
+	// the client only chunks once the server has said it can put the chunks back together, which it has by the time
+	// it has read a message from the server
+	for _, c := range []struct {
+		w interface{ WriteMessage(*Message) error }
+		r interface{ Read() (*Message, error) }
+	}{{sc, cc}, {cc, sc}} {
+
+		err := c.w.WriteMessage(&Message{MsgType: 5, Data: data, Headers: map[string]string{HeaderContentType: "text/plain"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m, err := c.r.Read()
+		if err != nil || string(m.Data) != string(data) || m.Headers[HeaderContentType] != "text/plain" {
+			t.Error("a chunked message should arrive whole with its headers", err)
+		}
+	}
+
+	if read, written := tap.chunks(t, nil); read == 0 || written == 0 {
+		t.Error("the messages should have been sent in chunks both ways", read, written)
+	}
+
+	cc.Close()
+	sc.Close()
+}
+
+func TestDeadline(t *testing.T) {
+
+	sc, err := StartServer("test_deadline", &ServerConfig{Encryption: true, SuppressStatus: true, WriteBuffer: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired := make(chan *Message, 1)
+
+	cc, err2 := StartClient("test_deadline", &ClientConfig{Encryption: true, SuppressStatus: true, OnExpired: func(m *Message) {
+		expired <- &Message{MsgType: m.MsgType, Data: append([]byte(nil), m.Data...), Deadline: m.Deadline}
+	}})
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sc.WaitForStatus(ctx, Connected)
+	cc.WaitForStatus(ctx, Connected)
+
+	// the client isn't reading, so the read goroutine holds the first message and the second waits in the socket
+	sc.Write(5, []byte("first"))
+	sc.Write(6, []byte("late"), WithTTL(50*time.Millisecond))
+
+	time.Sleep(100 * time.Millisecond)
+
+	sc.Write(7, []byte("after"))
+
+	for _, want := range []int{5, 7} {
+		m, err := cc.Read()
+		if err != nil || m.MsgType != want {
+			t.Fatal("a message received after its deadline should be discarded", m.MsgType, err)
+		}
+	}
+
+	select {
+	case m := <-expired:
+		if m.MsgType != 6 || string(m.Data) != "late" || m.Deadline.IsZero() {
+			t.Error("OnExpired should be called with the expired message", m.MsgType)
+		}
+	default:
+		t.Error("OnExpired should have been called")
+	}
+
+	if cc.Stats().Expired != 1 {
+		t.Error("the client should count the expired message", cc.Stats().Expired)
+	}
+
+	// messages that expire while queued behind others aren't written at all
+	bulk := make([]byte, 1<<20)
+	for i := 0; i < 5; i++ {
+		sc.Write(5, bulk)
+	}
+	sc.Write(6, []byte("stale"), WithDeadline(time.Now().Add(20*time.Millisecond)))
+
+	time.Sleep(100 * time.Millisecond)
+
+	sc.Write(7, []byte("fresh"))
+
+	for i := 0; i < 6; i++ {
+		m, err := cc.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < 5 && m.MsgType != 5 || i == 5 && m.MsgType != 7 {
+			t.Fatal("the expired message shouldn't have been written", i, m.MsgType)
+		}
+	}
+
+	if sc.Stats().Dropped != 1 {
+		t.Error("the server should count the dropped message", sc.Stats().Dropped)
+	}
+
+	cc.Close()
+	sc.Close()
+}
+
+// fixedClock - a Clock that's always at the same time
+type fixedClock struct {
+	now time.Time
+}
+
+func (c fixedClock) Now() time.Time {
+	return c.now
+}
+
+func (c fixedClock) After(d time.Duration) <-chan time.Time {
+	return make(chan time.Time)
+}
+
+func TestDeadlineClock(t *testing.T) {
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// the deadline is set when each message is written, not when the option is made
+	ttl := WithTTL(time.Minute)
+
+	first := newWrite(start, 5, nil, []WriteOption{ttl})
+	second := newWrite(start.Add(time.Hour), 5, nil, []WriteOption{ttl})
+
+	if !first.Deadline.Equal(start.Add(time.Minute)) || !second.Deadline.Equal(start.Add(time.Hour+time.Minute)) {
+		t.Error("WithTTL should be relative to when the message is written", first.Deadline, second.Deadline)
+	}
+
+	if m := newWrite(start, 5, nil, []WriteOption{ttl, WithDeadline(start.Add(time.Second))}); !m.Deadline.Equal(start.Add(time.Second)) {
+		t.Error("the last deadline option should win", m.Deadline)
+	}
+
+	// a message that hasn't expired by the system clock, but has by the clock the writer was given
+	normal := make(chan *Message, 1)
+	normal <- &Message{MsgType: 5, Deadline: time.Now().Add(time.Hour)}
+
+	stats := newStats()
+	l := newLanes(make(chan *Message), normal, make(chan *Message), newMetrics(stats, nil), fixedClock{now: time.Now().Add(2 * time.Hour)})
+
+	if m, ok := l.next(); m != nil || !ok {
+		t.Error("the message should have expired by the writer's clock")
+	}
+
+	if stats.snapshot().Dropped != 1 {
+		t.Error("the expired message should be counted as dropped")
+	}
+}
+
+func TestOptions(t *testing.T) {
+
+	invalid := []struct {
+		server bool
+		opts   []Option
+	}{
+		{true, []Option{WithMaxMsgSize(100)}},
+		{true, []Option{WithMaxMsgSize(wire.MaxMsgSizeCap + 1)}},
+		{true, []Option{WithWriteBuffer(-1)}},
+		{true, []Option{WithWritePolicy(WritePolicy(7))}},
+		{true, []Option{WithWritePolicy(WriteDropOldest)}},
+		{true, []Option{WithMaxBatch(0)}},
+		{true, []Option{WithBatchLatency(-time.Second)}},
+		{true, []Option{WithTimeout(time.Second)}},
+		{false, []Option{WithTimeout(-time.Second)}},
+		{false, []Option{WithRetryTimer(0)}},
+		{false, []Option{WithMaxMsgSize(4096)}},
+		{false, []Option{WithUnmaskPermissions()}},
+		{false, []Option{WithTransport(nil)}},
+		{false, []Option{WithClock(nil)}},
+		{true, []Option{WithClock(realClock{})}},
+		{false, []Option{WithSocketActivation()}},
+	}
+
+	for i, c := range invalid {
+
+		var err error
+		if c.server {
+			_, err = NewServer("test_options_invalid", c.opts...)
+		} else {
+			_, err = NewClient("test_options_invalid", c.opts...)
+		}
+
+		if err == nil {
+			t.Error("options should have been rejected", i)
+		}
+	}
+
+	// the same checks apply to the configs
+	tap := &tapTransport{dir: t.TempDir()}
+
+	if _, err := StartServer("test_options_invalid", &ServerConfig{SocketActivation: true, Transport: tap}); err == nil {
+		t.Error("socket activation with a transport should have been rejected")
+	}
+
+	if _, err := StartClient("test_options_invalid", &ClientConfig{SharedMemory: true, Transport: tap}); err == nil {
+		t.Error("shared memory with a transport should have been rejected")
+	}
+
+	if _, err := StartClient("test_options_invalid", &ClientConfig{ClientID: strings.Repeat("x", 300)}); err == nil {
+		t.Error("a client ID over 256 bytes should have been rejected")
+	}
+
+	sc, err := NewServer("test_options", WithMaxMsgSize(4096), WithSuppressStatus(), WithWriteBuffer(4), WithWritePolicy(WriteDropOldest))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := NewClient("test_options", WithTimeout(2*time.Second), WithRetryTimer(10*time.Millisecond), WithSuppressStatus())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := cc.WaitForStatus(ctx, Connected); err != nil {
+		t.Fatal(err)
+	}
+
+	cc.mutex.Lock()
+	max := cc.maxMsgSize
+	cc.mutex.Unlock()
+
+	if max != 4096 {
+		t.Error("client should get the max message size set with WithMaxMsgSize")
+	}
+
+	if err := cc.Write(5, make([]byte, 4097)); err == nil {
+		t.Error("message over the max message size should be rejected")
+	}
+
+	if err := cc.Write(5, []byte("options")); err != nil {
+		t.Error(err)
+	}
+
+	m, err := sc.Read()
+	if err != nil || string(m.Data) != "options" {
+		t.Error("server should receive the message", err)
+	}
+
+	cc.Close()
+	sc.Close()
+
+	// a client with a short timeout and retry timer gives up quickly when there's no server
+	start := time.Now()
+
+	c2, err := NewClient("test_options_none", WithTimeout(300*time.Millisecond), WithRetryTimer(50*time.Millisecond), WithSuppressStatus())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// timing out on the first attempt closes the client
+	if err := c2.WaitForStatus(ctx, Closed); err != nil {
+		t.Fatal(err)
+	}
+
+	if time.Since(start) > 2*time.Second {
+		t.Error("the timeout should be a real duration, not a number of seconds")
+	}
+}
+
+func TestReconnectPolicy(t *testing.T) {
+
+	b := ExponentialBackoff{Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond}
+
+	for attempt, want := range []time.Duration{10, 20, 40, 50, 50} {
+		if d, ok := b.NextDelay(attempt+1, 0); !ok || d != want*time.Millisecond {
+			t.Error("unexpected exponential backoff", attempt+1, d, ok)
+		}
+	}
+
+	jitter := ExponentialBackoff{Initial: 100 * time.Millisecond, Jitter: 0.5}
+
+	for i := 0; i < 100; i++ {
+		if d, _ := jitter.NextDelay(1, 0); d < 50*time.Millisecond || d > 100*time.Millisecond {
+			t.Fatal("jitter should take up to half the wait off", d)
+		}
+	}
+
+	if _, ok := MaxAttempts(b, 3).NextDelay(3, 0); ok {
+		t.Error("MaxAttempts should give up after 3 attempts")
+	}
+
+	if _, ok := MaxElapsed(b, time.Second).NextDelay(1, 995*time.Millisecond); ok {
+		t.Error("MaxElapsed should give up once the next attempt would be too late")
+	}
+
+	// each failed attempt is reported with the wait before the next one, then the client gives up
+	c, err := NewClient("test_reconnect_policy_none", WithReconnectPolicy(MaxAttempts(b, 3)), WithSuppressStatus())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := c.WaitForStatus(ctx, Closed); err != nil {
+		t.Fatal(err)
+	}
+
+	var attempts []Event
+
+	for len(c.Events()) > 0 {
+		if e := <-c.Events(); e.Attempt > 0 {
+			attempts = append(attempts, e)
+		}
+	}
+
+	if len(attempts) != 2 || attempts[0].NextDelay != 10*time.Millisecond || attempts[1].Attempt != 2 || attempts[1].NextDelay != 20*time.Millisecond {
+		t.Error("unexpected attempt events", attempts)
+	}
+
+	if _, err := NewClient("test_reconnect_policy_none", WithReconnectPolicy(nil)); err == nil {
+		t.Error("nil reconnect policy should be rejected")
+	}
+
+	if _, err := NewServer("test_reconnect_policy_none", WithoutReconnect()); err == nil {
+		t.Error("WithoutReconnect should be rejected by a server")
+	}
+
+	// without reconnect the client stays disconnected when the server goes away
+	sc, err := NewServer("test_reconnect_disabled", WithSuppressStatus())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := NewClient("test_reconnect_disabled", WithoutReconnect(), WithRetryTimer(10*time.Millisecond), WithSuppressStatus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	if err := cc.WaitForStatus(ctx, Connected); err != nil {
+		t.Fatal(err)
+	}
+
+	sc.Close()
+
+	if err := cc.WaitForStatus(ctx, Disconnected); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	if st := cc.Stats(); st.ReconnectAttempts != 0 || cc.getStatus() != Disconnected {
+		t.Error("client shouldn't try to reconnect", st.ReconnectAttempts, cc.getStatus())
+	}
+}
+
+func TestClientID(t *testing.T) {
+
+	if _, err := NewClient("test_client_id", WithClientID("")); err == nil {
+		t.Error("empty client ID should be rejected")
+	}
+
+	if _, err := StartClient("test_client_id", &ClientConfig{ClientID: strings.Repeat("x", 257)}); err == nil {
+		t.Error("client ID over 256 bytes should be rejected")
+	}
+
+	if _, err := NewServer("test_client_id", WithClientID("worker-1")); err == nil {
+		t.Error("WithClientID should be rejected by a server")
+	}
+
+	sc, err := NewServer("test_client_id", WithSuppressStatus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// waits for the server's next Connected event and returns the client's details
+	connected := func() *Peer {
+		for {
+			select {
+			case e := <-sc.Events():
+				if e.Status == Connected && e.Err == nil {
+					return e.Peer
+				}
+			case <-ctx.Done():
+				t.Fatal("server didn't see the client connect")
+			}
+		}
+	}
+
+	for i, returning := range []bool{false, true} {
+
+		cc, err := NewClient("test_client_id", WithClientID("worker-1"), WithRetryTimer(10*time.Millisecond), WithSuppressStatus())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if p := connected(); p.ClientID != "worker-1" || p.Returning != returning {
+			t.Error("server should see the client's ID", i, p.ClientID, p.Returning)
+		}
+
+		cc.Close()
+
+		if err := sc.WaitForStatus(ctx, Disconnected); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// without an ID the client makes one up, which lasts as long as the client
+	cc, err := StartClient("test_client_id", &ClientConfig{Encryption: true, RetryTimer: 1, SuppressStatus: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	if p := connected(); len(cc.ClientID()) != 32 || p.ClientID != cc.ClientID() || p.Returning {
+		t.Error("server should see the client's random ID", cc.ClientID(), p.ClientID, p.Returning)
+	}
+}
+
+func TestClientWaitsForBusyServer(t *testing.T) {
+
+	handshakeTimeout = 300 * time.Millisecond
+	defer func() { handshakeTimeout = 10 * time.Second }()
+
+	sc, err := NewServer("test_busy", WithSuppressStatus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Shutdown(context.Background()) // waits for the accept loop before handshakeTimeout is put back
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	first, err := NewClient("test_busy", WithClientID("worker-1"), WithRetryTimer(50*time.Millisecond), WithSuppressStatus())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := first.WaitForStatus(ctx, Connected); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server only handles one client at a time, the second keeps trying until the first has gone
+	second, err := NewClient("test_busy", WithClientID("worker-1"), WithRetryTimer(50*time.Millisecond), WithSuppressStatus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	time.Sleep(3 * handshakeTimeout)
+
+	if second.StatusCode() != Connecting {
+		t.Fatal("the second client should still be trying to connect", second.Status())
+	}
+
+	first.Close()
+
+	if err := second.WaitForStatus(ctx, Connected); err != nil {
+		t.Fatal("the second client should connect once the first has gone", second.Status())
+	}
+}
+
+// fuzzConn - a net.Conn that reads the fuzz input and discards everything written to it
+type fuzzConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *fuzzConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *fuzzConn) Write(b []byte) (int, error) { return len(b), nil }
+func (c *fuzzConn) Close() error                { return nil }
+
+func fuzzCipher(t testing.TB) cipher.AEAD {
+
+	g, err := createCipher([32]byte{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return *g
+}
+
+// FuzzFrame - frames read with wire.Decoder, including the control messages carried in them, must never panic
+func FuzzFrame(f *testing.F) {
+
+	g := fuzzCipher(f)
+
+	for _, c := range []cipher.AEAD{nil, g} {
+
+		b, _ := wire.AppendFrame(nil, c, 5, []byte("hello"))
+		f.Add(b, c != nil)
+
+		b, _ = appendHeadersFrame(nil, c, map[string]string{HeaderCorrelationID: "1"})
+		f.Add(b, c != nil)
+
+		b, _ = wire.AppendFrame(nil, c, 0, []byte{ctrlChunk, 1, 1, 0, 0, 0, 5, 'h', 'i'})
+		f.Add(b, c != nil)
+	}
+
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff}, false)
+	f.Add([]byte{0, 0, 0, 2, 0, 0}, false)
+
+	f.Fuzz(func(t *testing.T, b []byte, encrypted bool) {
+
+		var c cipher.AEAD
+		if encrypted {
+			c = g
+		}
+
+		sess := &session{}
+		dec := wire.NewDecoder(bytes.NewReader(b), c, 4096)
+
+		for {
+
+			f, err := dec.Decode()
+			var decryptErr *wire.DecryptError
+			if errors.As(err, &decryptErr) {
+				continue
+			}
+			if err != nil {
+				return
+			}
+
+			data := f.Data
+			if f.MsgType != 0 {
+				continue
+			}
+
+			code, _ := control(data)
+			switch code {
+			case ctrlChunk:
+				sess.addChunk(data[1:], 4096)
+			case ctrlFiles:
+				sess.takeFiles(data[1:])
+			}
+
+			deadline(map[string]string{HeaderDeadline: string(data)})
+		}
+	})
+}
+
+// FuzzFrameRoundTrip - whatever is framed is read back the same
+func FuzzFrameRoundTrip(f *testing.F) {
+
+	g := fuzzCipher(f)
+
+	f.Add(5, []byte("hello"), true)
+	f.Add(1, []byte{}, false)
+
+	f.Fuzz(func(t *testing.T, msgType int, data []byte, encrypted bool) {
+
+		var c cipher.AEAD
+		if encrypted {
+			c = g
+		}
+
+		b, err := wire.AppendFrame(nil, c, msgType, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l, err := wire.FrameLength(b[:4], len(data))
+		if err != nil || l != len(b)-4 {
+			t.Fatal("bad frame length", l, err)
+		}
+
+		frame := b[4:]
+		if c != nil {
+			if frame, err = wire.OpenFrame(c, frame); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		mt, d, err := wire.SplitFrame(frame)
+		if err != nil || mt != int(uint32(msgType)) || !bytes.Equal(d, data) {
+			t.Fatal("frame didn't round trip", mt, err)
+		}
+	})
+}
+
+// FuzzMsgLength - the max message length sent by the server during the handshake
+func FuzzMsgLength(f *testing.F) {
+
+	f.Add([]byte{0, 0, 0, 4, 0, 0, 16, 0})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0, 0, 0, 2, 0, 0})
+	f.Add([]byte{0, 0, 0, 4, 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+
+		cc := &Client{conn: &fuzzConn{r: bytes.NewReader(b)}}
+
+		if err := cc.msgLength(); err == nil && (cc.maxMsgSize < 1024 || cc.maxMsgSize > wire.MaxMsgSizeCap) {
+			t.Fatal("max message length out of range accepted", cc.maxMsgSize)
+		}
+	})
+}
+
+// FuzzRecvPublic - the public key sent by the other end during the key exchange
+func FuzzRecvPublic(f *testing.F) {
+
+	_, pub, err := generateKeys()
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Add(publicKeyToBytes(pub))
+	f.Add(make([]byte, 97))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+
+		if pub, err := recvPublic(bytes.NewReader(b)); err == nil && !pub.IsOnCurve(pub.X, pub.Y) {
+			t.Fatal("public key isn't on the curve")
+		}
+	})
+}
+
+// FuzzHandshake - each end of the handshake against whatever the other end sends
+func FuzzHandshake(f *testing.F) {
+
+	f.Add([]byte{version, 0, 0, 0, 0, 4, 0, 0, 16, 0}, false)
+	f.Add([]byte{version, 1}, false)
+	f.Add([]byte{0, byte(capHeaders | capSharedMemory)}, true)
+	f.Add([]byte{1}, true)
+
+	f.Fuzz(func(t *testing.T, b []byte, server bool) {
+
+		conn := &fuzzConn{r: bytes.NewReader(b)}
+
+		if server {
+			sc := &Server{conn: conn, maxMsgSize: maxMsgSize}
+			sc.handshake()
+			return
+		}
+
+		cc := &Client{conn: conn}
+		if cc.handshake() == nil && (cc.maxMsgSize < 1024 || cc.maxMsgSize > wire.MaxMsgSizeCap) {
+			t.Fatal("max message length out of range accepted", cc.maxMsgSize)
+		}
+	})
+}
+
+func TestFrameTooLong(t *testing.T) {
+
+	sc, err := StartServer("test_frame_too_long", &ServerConfig{Encryption: false, SuppressStatus: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	cc, err := StartClient("test_frame_too_long", &ClientConfig{Encryption: false, RetryTimer: 1, SuppressStatus: true, DisableReconnect: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := sc.WaitForStatus(ctx, Connected); err != nil {
+		t.Fatal(err)
+	}
+
+	// a length prefix of 4GB, the server mustn't try to allocate it
+	cc.mutex.Lock()
+	cc.conn.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	cc.mutex.Unlock()
+
+	if _, err := sc.Read(); err == nil || err.Error() != "frame exceeds maximum message length" {
+		t.Fatal("server should report the frame is too long", err)
+	}
+
+	if err := sc.WaitForStatus(ctx, Disconnected); err != nil {
+		t.Fatal("server should drop the connection", err)
+	}
+}
+
+func TestBadHandshake(t *testing.T) {
+
+	handshakeTimeout = time.Second / 2
+	defer func() { handshakeTimeout = 10 * time.Second }()
+
+	sc, err := StartServer("test_bad_handshake", &ServerConfig{Encryption: true, SuppressStatus: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Shutdown(context.Background()) // waits for the accept loop before handshakeTimeout is put back
+
+	// a client that never replies to the hello is dropped once the handshake times out
+	silent, err := net.Dial("unix", "/tmp/test_bad_handshake.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	silent.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if b, err := io.ReadAll(silent); err != nil || len(b) != 2 {
+		t.Fatal("server should send the hello then drop a silent client", len(b), err)
+	}
+
+	// one that fails the handshake is dropped, and the server carries on listening
+	bad, err := net.Dial("unix", "/tmp/test_bad_handshake.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+
+	if _, err := io.ReadFull(bad, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	bad.Write([]byte{wire.ReplyVersion})
+
+	cc, err := StartClient("test_bad_handshake", &ClientConfig{Encryption: true, SuppressStatus: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := cc.WaitForStatus(ctx, Connected); err != nil {
+		t.Fatal("client should connect after the bad handshakes", err)
+	}
+
+	if err := cc.Write(5, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if m, err := sc.Read(); err != nil || m.MsgType != 5 {
+		t.Fatal("server should read the message", m, err)
+	}
+
+	for e := range sc.Events() {
+		if e.Err != nil && e.Err.Error() == "client has a different version number" {
+			break
+		}
+		if e.Status == Connected {
+			t.Fatal("the failed handshake should be sent to Events()")
+		}
+	}
+}
+
+func TestServiceRegistry(t *testing.T) {
+
+	dir := t.TempDir()
+
+	if _, err := NewServiceClient("test.protocol", WithRegistryDir(dir)); err == nil {
+		t.Error("there should be an error when no server is running for the protocol")
+	}
+
+	sc, err := NewServer("test_registry", WithService("test.protocol", "1.2"), WithRegistryDir(dir), WithSuppressStatus())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := StartServer("test_registry2", &ServerConfig{Service: "test.other", RegistryDir: dir, SuppressStatus: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	servers, err := ListServersIn(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(servers) != 2 || servers[0].Name != "test_registry" || servers[1].Name != "test_registry2" {
+		t.Fatalf("expected both servers in the registry, got %+v", servers)
+	}
+
+	if s := servers[0]; s.Protocol != "test.protocol" || s.Version != "1.2" || s.PID != os.Getpid() || s.Addr == "" || s.Started.IsZero() {
+		t.Errorf("unexpected entry %+v", s)
+	}
+
+	cc, err := NewServiceClient("test.protocol", WithRegistryDir(dir), WithSuppressStatus())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cc.Name != "test_registry" {
+		t.Errorf("expected the client to connect to test_registry, got %s", cc.Name)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := cc.WaitForStatus(ctx, Connected); err != nil {
+		t.Fatal(err)
+	}
+
+	cc.Write(5, []byte("hello"))
+
+	m, err := sc.Read()
+	if err != nil || m.MsgType != 5 || string(m.Data) != "hello" {
+		t.Error("server should receive the message sent through the registry", m, err)
+	}
+
+	cc.Close()
+	sc.Close()
+
+	servers, _ = ListServersIn(dir)
+	if len(servers) != 1 || servers[0].Name != "test_registry2" {
+		t.Errorf("closing the server should remove its entry, got %+v", servers)
+	}
+
+	other.Shutdown(ctx)
+
+	servers, _ = ListServersIn(dir)
+	if len(servers) != 0 {
+		t.Errorf("shutting down the server should remove its entry, got %+v", servers)
+	}
+}
+
+func TestServiceRegistryStale(t *testing.T) {
+
+	dir := t.TempDir()
+
+	// no process can have the highest pid
+	stale := `{"name":"test_stale","protocol":"test.protocol","pid":2147483647,"started":"2020-01-01T00:00:00Z"}`
+	if err := os.WriteFile(filepath.Join(dir, "test_stale.json"), []byte(stale), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "broken.json"), []byte("{not json"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	servers, err := ListServersIn(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(servers) != 0 {
+		t.Errorf("expected the stale entry to be skipped, got %+v", servers)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "test_stale.json")); !os.IsNotExist(err) {
+		t.Error("the stale entry should have been removed")
+	}
+
+	if _, err := NewServiceClient("test.protocol", WithRegistryDir(dir)); err == nil {
+		t.Error("a client shouldn't connect to a stale entry")
+	}
+
+	if _, err := NewServer("test_registry3", WithService("", "1")); err == nil {
+		t.Error("WithService should need a protocol")
+	}
+
+	if _, err := NewClient("test_registry3", WithService("test.protocol", "1")); err == nil {
+		t.Error("WithService should only apply to a server")
+	}
+}
+
+func TestServiceRegistryOwner(t *testing.T) {
+
+	dir := filepath.Join(t.TempDir(), "registry")
+
+	if err := makeRegistryDir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := os.Stat(dir); err != nil || (runtime.GOOS != "windows" && info.Mode().Perm() != 0700) {
+		t.Fatal("only the user should be able to use the registry directory", err)
+	}
+
+	entry := fmt.Sprintf(`{"name":"test_registry_owner","protocol":"test.protocol","pid":%d,"started":"2020-01-01T00:00:00Z"}`, os.Getpid())
+	file := filepath.Join(dir, "test_registry_owner.json")
+
+	if err := os.WriteFile(file, []byte(entry), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if servers, err := ListServersIn(dir); err != nil || len(servers) != 1 {
+		t.Fatal("the user's own entry should be listed", servers, err)
+	}
+
+	if err := os.Chown(file, os.Getuid()+1, -1); err != nil {
+		t.Skip("changing the owner of a file needs root")
+	}
+
+	if servers, err := ListServersIn(dir); err != nil || len(servers) != 0 {
+		t.Error("an entry that belongs to another user should be ignored", servers, err)
+	}
+
+	if err := os.Chown(dir, os.Getuid()+1, -1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewServer("test_registry_owner", WithService("test.protocol", "1"), WithRegistryDir(dir), WithSuppressStatus()); err == nil {
+		t.Error("a server shouldn't register in a directory that belongs to another user")
+	}
+}
+
+func TestSocketActivation(t *testing.T) {
+
+	if runtime.GOOS != "linux" {
+		t.Skip("socket activation is only supported on linux")
+	}
+
+	if _, err := NewServer("test_activation", WithSocketActivation()); err == nil {
+		t.Error("there should be an error when systemd hasn't passed a socket")
+	}
+
+	// stands in for systemd, which creates the socket and passes it to the service as fd 3
+	sock := "/tmp/test_activation.sock"
+	os.Remove(sock)
+
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(sock)
+
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	f, err := l.(*net.UnixListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSocketActivationService$")
+	cmd.Env = append(os.Environ(), "IPC_TEST_ACTIVATION=1", "LISTEN_FDS=1", "LISTEN_FDNAMES=test_activation")
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Close()
+	l.Close()
+
+	cc, err := NewClient("test_activation", WithSuppressStatus())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := cc.WaitForStatus(ctx, Connected); err != nil {
+		t.Fatal(err)
+	}
+
+	cc.Write(5, []byte("hello"))
+
+	m, err := cc.Read()
+	if err != nil || m.MsgType != 6 || string(m.Data) != "hello" {
+		t.Error("expected the service to send the message back", m, err)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		t.Error("the service failed", err)
+	}
+
+	cc.Close()
+
+	if _, err := os.Stat(sock); err != nil {
+		t.Error("the socket belongs to systemd, the server shouldn't remove it", err)
+	}
+}
+
+// TestSocketActivationService - the service started by TestSocketActivation
+func TestSocketActivationService(t *testing.T) {
+
+	if os.Getenv("IPC_TEST_ACTIVATION") != "1" {
+		t.Skip("started by TestSocketActivation")
+	}
+
+	// systemd sets this once it has forked
+	os.Setenv("LISTEN_PID", fmt.Sprint(os.Getpid()))
+
+	sc, err := NewServer("test_activation", WithSocketActivation(), WithSuppressStatus())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if _, ok := os.LookupEnv(v); ok {
+			t.Error(v + " should be unset once the socket has been adopted")
+		}
+	}
+
+	m, err := sc.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sc.Write(6, m.Data)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := sc.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,107 @@
+package ipctest
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// FakeClock - an ipc.Clock that only moves when Advance() is called, pass it to the client with ipc.WithClock()
+type FakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	timers  []timer
+	changed chan struct{} // closed when a timer is added, see BlockUntil()
+}
+
+type timer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// NewFakeClock - returns a FakeClock set to the current time
+func NewFakeClock() *FakeClock {
+
+	return &FakeClock{now: time.Now()}
+}
+
+// Now - the time on the fake clock
+func (fc *FakeClock) Now() time.Time {
+
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	return fc.now
+}
+
+// After - returns a channel that receives the time once the clock has been advanced by d
+func (fc *FakeClock) After(d time.Duration) <-chan time.Time {
+
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	ch := make(chan time.Time, 1)
+
+	if d <= 0 {
+		ch <- fc.now
+		return ch
+	}
+
+	fc.timers = append(fc.timers, timer{at: fc.now.Add(d), ch: ch})
+
+	if fc.changed != nil {
+		close(fc.changed)
+		fc.changed = nil
+	}
+
+	return ch
+}
+
+// Advance - moves the clock forward by d, firing the timers that are due
+func (fc *FakeClock) Advance(d time.Duration) {
+
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	fc.now = fc.now.Add(d)
+
+	pending := fc.timers[:0]
+
+	for _, t := range fc.timers {
+		if t.at.After(fc.now) {
+			pending = append(pending, t)
+		} else {
+			t.ch <- fc.now
+		}
+	}
+
+	fc.timers = pending
+}
+
+// BlockUntil - waits until there are at least n timers waiting for the clock to be advanced, or ctx ends.
+// Use it before Advance() so the client is waiting when the clock moves.
+func (fc *FakeClock) BlockUntil(ctx context.Context, n int) error {
+
+	for {
+
+		fc.mutex.Lock()
+
+		if len(fc.timers) >= n {
+			fc.mutex.Unlock()
+			return nil
+		}
+
+		if fc.changed == nil {
+			fc.changed = make(chan struct{})
+		}
+		changed := fc.changed
+
+		fc.mutex.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
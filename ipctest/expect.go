@@ -0,0 +1,75 @@
+package ipctest
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	ipc "github.com/james-barrow/golang-ipc"
+)
+
+// Reader - the Read() method of ipc.Server and ipc.Client
+type Reader interface {
+	Read() (*ipc.Message, error)
+}
+
+// ExpectMessage - reads the next message and fails the test if it doesn't have msgType and data, or doesn't arrive within Timeout.
+// Returns the message so the headers etc can be checked.
+func ExpectMessage(t testing.TB, r Reader, msgType int, data []byte) *ipc.Message {
+
+	t.Helper()
+
+	type result struct {
+		m   *ipc.Message
+		err error
+	}
+
+	received := make(chan result, 1)
+
+	// if the message never arrives this goroutine is left reading, the test has failed anyway
+	go func() {
+		m, err := r.Read()
+		received <- result{m, err}
+	}()
+
+	select {
+	case res := <-received:
+		if res.err != nil {
+			t.Fatal("read failed: ", res.err)
+		}
+		if res.m.MsgType != msgType || !bytes.Equal(res.m.Data, data) {
+			t.Fatalf("expected message type %d %q, received type %d %q", msgType, data, res.m.MsgType, res.m.Data)
+		}
+		return res.m
+	case <-time.After(Timeout):
+		t.Fatalf("expected message type %d %q, nothing received", msgType, data)
+	}
+
+	return nil
+}
+
+// ExpectStatus - fails the test unless the next status changes on events are statuses, in order, within Timeout each.
+// Errors and attempts to connect are skipped, pass Events() from the server or client.
+func ExpectStatus(t testing.TB, events <-chan ipc.Event, statuses ...ipc.Status) {
+
+	t.Helper()
+
+	for _, want := range statuses {
+
+		for {
+			select {
+			case e := <-events:
+				if e.Err != nil || e.Attempt > 0 {
+					continue
+				}
+				if e.Status != want {
+					t.Fatalf("expected status %s, got %s", want.String(), e.Status.String())
+				}
+			case <-time.After(Timeout):
+				t.Fatalf("expected status %s, nothing received", want.String())
+			}
+
+			break
+		}
+	}
+}
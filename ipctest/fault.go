@@ -0,0 +1,290 @@
+package ipctest
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	ipc "github.com/james-barrow/golang-ipc"
+)
+
+// ErrInjected - returned by Read or Write when a Disconnect fault closes the connection
+var ErrInjected = errors.New("ipctest: injected disconnect")
+
+// Op - the call a fault applies to
+type Op int
+
+const (
+	// OpAny - either Read or Write
+	OpAny Op = iota
+	// OpRead - Read
+	OpRead
+	// OpWrite - Write
+	OpWrite
+)
+
+// FaultKind - what goes wrong
+type FaultKind int
+
+const (
+	// Latency - the call waits for Fault.Delay first
+	Latency FaultKind = iota + 1
+	// Partial - the call only reads half of the buffer, or writes it in two halves
+	Partial
+	// Disconnect - the connection is closed instead of making the call, ErrInjected is returned
+	Disconnect
+	// Corrupt - the last byte read or written is flipped, with encryption the frame fails to decrypt
+	Corrupt
+	// Stall - the call blocks until the connection is closed, as if the peer has hung
+	Stall
+)
+
+// Fault - a fault at a set point on a connection, see Faults.Script
+type Fault struct {
+	Conn  int // which connection, 1 is the first dialed or accepted through the FaultTransport. 0 is every connection
+	Op    Op  // which calls are counted
+	Call  int // the call on the connection the fault applies to, 1 is the first. 0 is every call
+	Kind  FaultKind
+	Delay time.Duration // how long a Latency fault waits
+}
+
+// Faults - what goes wrong on the connections made through a FaultTransport.
+// Scripted faults happen exactly where they're put, the rates are checked at random on every Read and Write after them.
+type Faults struct {
+	Script []Fault // faults at set points, e.g. {Conn: 1, Op: OpWrite, Call: 5, Kind: Disconnect}
+
+	Latency        time.Duration // added to every Read and Write
+	Jitter         time.Duration // up to this much is randomly added to Latency
+	PartialRate    float64       // fraction of calls, 0 to 1, that only read or write part of the buffer
+	DisconnectRate float64       // fraction of calls that close the connection
+	CorruptRate    float64       // fraction of calls that flip a byte
+	StallRate      float64       // fraction of calls that block until the connection is closed
+
+	Seed int64 // seeds the random faults so a failure can be repeated (default is 0, seeded from the time)
+}
+
+// FaultTransport - an ipc.Transport that injects faults into the connections made through another transport, e.g. a Network.
+// Pass it to one end with ipc.WithTransport() and the plain transport to the other, so only that end sees the faults.
+type FaultTransport struct {
+	transport ipc.Transport
+	faults    Faults
+
+	mutex    sync.Mutex // guards everything below
+	rand     *rand.Rand
+	conns    int
+	injected []Fault
+}
+
+// NewFaultTransport - wraps transport, faults can't be changed once it has been created
+func NewFaultTransport(transport ipc.Transport, faults Faults) *FaultTransport {
+
+	seed := faults.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	return &FaultTransport{transport: transport, faults: faults, rand: rand.New(rand.NewSource(seed))}
+}
+
+// Listen - each connection accepted has faults injected
+func (ft *FaultTransport) Listen(name string) (net.Listener, error) {
+
+	l, err := ft.transport.Listen(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &faultListener{Listener: l, ft: ft}, nil
+}
+
+// Dial - the connection has faults injected
+func (ft *FaultTransport) Dial(name string) (net.Conn, error) {
+
+	conn, err := ft.transport.Dial(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return ft.wrap(conn), nil
+}
+
+// Injected - the faults that have happened so far, with the connection, op and call they happened on. Latency isn't included
+func (ft *FaultTransport) Injected() []Fault {
+
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+
+	return append([]Fault(nil), ft.injected...)
+}
+
+func (ft *FaultTransport) wrap(conn net.Conn) net.Conn {
+
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+
+	ft.conns++
+
+	return &faultConn{Conn: conn, ft: ft, id: ft.conns, closed: make(chan struct{})}
+}
+
+// pick - the fault for the call, the first scripted fault that matches or else one of the random ones
+func (ft *FaultTransport) pick(conn, call int, op Op) Fault {
+
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+
+	f := Fault{Conn: conn, Op: op, Call: call}
+
+	for _, s := range ft.faults.Script {
+		if (s.Conn == 0 || s.Conn == conn) && (s.Op == OpAny || s.Op == op) && (s.Call == 0 || s.Call == call) {
+			f.Kind = s.Kind
+			f.Delay = s.Delay
+			break
+		}
+	}
+
+	if f.Kind == 0 {
+		switch {
+		case ft.roll(ft.faults.DisconnectRate):
+			f.Kind = Disconnect
+		case ft.roll(ft.faults.StallRate):
+			f.Kind = Stall
+		case ft.roll(ft.faults.CorruptRate):
+			f.Kind = Corrupt
+		case ft.roll(ft.faults.PartialRate):
+			f.Kind = Partial
+		}
+	}
+
+	if f.Kind != 0 && f.Kind != Latency {
+		ft.injected = append(ft.injected, f)
+	}
+
+	f.Delay += ft.faults.Latency
+	if ft.faults.Jitter > 0 {
+		f.Delay += time.Duration(ft.rand.Int63n(int64(ft.faults.Jitter)))
+	}
+
+	return f
+}
+
+func (ft *FaultTransport) roll(rate float64) bool {
+
+	return rate > 0 && ft.rand.Float64() < rate
+}
+
+// faultListener - wraps each connection accepted
+type faultListener struct {
+	net.Listener
+	ft *FaultTransport
+}
+
+func (l *faultListener) Accept() (net.Conn, error) {
+
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return l.ft.wrap(conn), nil
+}
+
+// faultConn - a connection with faults injected, reads and writes are counted separately
+type faultConn struct {
+	net.Conn
+	ft *FaultTransport
+	id int
+
+	mutex  sync.Mutex // guards reads and writes
+	reads  int
+	writes int
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// next - counts the call and picks its fault, then waits for any latency
+func (c *faultConn) next(op Op) Fault {
+
+	c.mutex.Lock()
+	call := 0
+	if op == OpRead {
+		c.reads++
+		call = c.reads
+	} else {
+		c.writes++
+		call = c.writes
+	}
+	c.mutex.Unlock()
+
+	f := c.ft.pick(c.id, call, op)
+
+	if f.Delay > 0 {
+		select {
+		case <-time.After(f.Delay):
+		case <-c.closed:
+		}
+	}
+
+	return f
+}
+
+func (c *faultConn) Read(p []byte) (int, error) {
+
+	switch f := c.next(OpRead); f.Kind {
+	case Disconnect:
+		c.Close()
+		return 0, ErrInjected
+	case Stall:
+		<-c.closed
+	case Partial:
+		if len(p) > 1 {
+			p = p[:len(p)/2]
+		}
+	case Corrupt:
+		n, err := c.Conn.Read(p)
+		if n > 0 {
+			p[n-1] ^= 0xff
+		}
+		return n, err
+	}
+
+	return c.Conn.Read(p)
+}
+
+func (c *faultConn) Write(p []byte) (int, error) {
+
+	switch f := c.next(OpWrite); f.Kind {
+	case Disconnect:
+		c.Close()
+		return 0, ErrInjected
+	case Stall:
+		<-c.closed
+	case Partial:
+		if len(p) > 1 {
+			n, err := c.Conn.Write(p[:len(p)/2])
+			if err != nil {
+				return n, err
+			}
+			m, err := c.Conn.Write(p[len(p)/2:])
+			return n + m, err
+		}
+	case Corrupt:
+		if len(p) > 0 {
+			q := append([]byte(nil), p...)
+			q[len(q)-1] ^= 0xff
+			return c.Conn.Write(q)
+		}
+	}
+
+	return c.Conn.Write(p)
+}
+
+func (c *faultConn) Close() error {
+
+	c.closeOnce.Do(func() { close(c.closed) })
+
+	return c.Conn.Close()
+}
@@ -0,0 +1,295 @@
+package ipctest
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	ipc "github.com/james-barrow/golang-ipc"
+)
+
+func TestPair(t *testing.T) {
+
+	s, c := NewPair(t)
+
+	if err := c.Write(5, []byte("hello server")); err != nil {
+		t.Fatal(err)
+	}
+
+	ExpectMessage(t, s, 5, []byte("hello server"))
+
+	if err := s.WriteMessage(&ipc.Message{MsgType: 6, Data: []byte("hello client"), Headers: map[string]string{"k": "v"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if m := ExpectMessage(t, c, 6, []byte("hello client")); m.Headers["k"] != "v" {
+		t.Error("headers should be sent over the in-memory transport", m.Headers)
+	}
+}
+
+func TestPairUnencrypted(t *testing.T) {
+
+	s, c := NewPair(t, ServerOptions(ipc.WithEncryption(false), ipc.WithMaxMsgSize(1024)), ClientOptions(ipc.WithEncryption(false)))
+
+	if err := s.Write(5, make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+
+	ExpectMessage(t, c, 5, make([]byte, 1024))
+
+	if err := c.Write(5, make([]byte, 1025)); err == nil {
+		t.Error("client should get the server's max message size")
+	}
+}
+
+func TestNetwork(t *testing.T) {
+
+	n := NewNetwork()
+
+	if _, err := n.Dial("test"); err == nil {
+		t.Error("dial should fail when nothing is listening")
+	}
+
+	l, err := n.Listen("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := n.Listen("test"); err == nil {
+		t.Error("only one server can listen on a name")
+	}
+
+	conn, err := n.Dial("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.Close()
+
+	if _, err := l.Accept(); err == nil {
+		t.Error("accept should fail once the listener is closed")
+	}
+
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("connections waiting to be accepted should be closed with the listener")
+	}
+
+	if _, err := n.Listen("test"); err != nil {
+		t.Error("the name should be free once the listener is closed", err)
+	}
+}
+
+func TestReconnectWithFakeClock(t *testing.T) {
+
+	n := NewNetwork()
+	fc := NewFakeClock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+
+	c, err := ipc.NewClient("test", ipc.WithTransport(n), ipc.WithClock(fc), ipc.WithReconnectPolicy(ipc.ConstantBackoff{Delay: time.Hour}), ipc.WithSuppressStatus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the client waits an hour after the first attempt, the server starts in the meantime
+	if err := fc.BlockUntil(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := ipc.NewServer("test", ipc.WithTransport(n), ipc.WithSuppressStatus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	fc.Advance(time.Hour)
+
+	ExpectStatus(t, c.Events(), ipc.Connecting, ipc.Connected)
+
+	// the server goes away and comes back, the client reconnects after another hour
+	s.Close()
+
+	ExpectStatus(t, c.Events(), ipc.ReConnecting)
+
+	if err := fc.BlockUntil(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = ipc.NewServer("test", ipc.WithTransport(n), ipc.WithSuppressStatus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	fc.Advance(time.Hour)
+
+	ExpectStatus(t, c.Events(), ipc.Connected)
+
+	if err := c.Write(5, []byte("reconnected")); err != nil {
+		t.Fatal(err)
+	}
+
+	ExpectMessage(t, s, 5, []byte("reconnected"))
+}
+
+func TestTimeoutWithFakeClock(t *testing.T) {
+
+	n := NewNetwork()
+	fc := NewFakeClock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+
+	c, err := ipc.NewClient("test", ipc.WithTransport(n), ipc.WithClock(fc), ipc.WithTimeout(time.Minute), ipc.WithRetryTimer(10*time.Second), ipc.WithSuppressStatus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 6; i++ {
+		if err := fc.BlockUntil(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+		fc.Advance(10 * time.Second)
+	}
+
+	ExpectStatus(t, c.Events(), ipc.Connecting, ipc.Closed)
+}
+
+// faultPair - a server listening through one transport and a client connecting through the other, once both are connected
+func faultPair(t *testing.T, server ipc.Transport, client ipc.Transport) (*ipc.Server, *ipc.Client) {
+
+	t.Helper()
+
+	s, err := ipc.NewServer("faults", ipc.WithTransport(server), ipc.WithSuppressStatus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+
+	c, err := ipc.NewClient("faults", ipc.WithTransport(client), ipc.WithSuppressStatus(), ipc.WithRetryTimer(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+
+	ExpectStatus(t, c.Events(), ipc.Connecting, ipc.Connected)
+
+	// the client can be connected before the server has finished its side of the handshake
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+
+	if err := s.WaitForStatus(ctx, ipc.Connected); err != nil {
+		t.Fatal("server didn't connect")
+	}
+
+	return s, c
+}
+
+func TestFaultDisconnect(t *testing.T) {
+
+	network := NewNetwork()
+
+	// the client's handshake takes 4 writes, so the 5th is the first message
+	ft := NewFaultTransport(network, Faults{Script: []Fault{{Conn: 1, Op: OpWrite, Call: 5, Kind: Disconnect}}})
+
+	s, c := faultPair(t, network, ft)
+
+	c.Write(5, []byte("lost"))
+
+	ExpectStatus(t, c.Events(), ipc.ReConnecting, ipc.Connected)
+
+	c.Write(5, []byte("after reconnecting"))
+	ExpectMessage(t, s, 5, []byte("after reconnecting"))
+
+	injected := ft.Injected()
+	if len(injected) != 1 || injected[0] != (Fault{Conn: 1, Op: OpWrite, Call: 5, Kind: Disconnect}) {
+		t.Errorf("unexpected faults %+v", injected)
+	}
+}
+
+func TestFaultCorrupt(t *testing.T) {
+
+	network := NewNetwork()
+
+	// the server's handshake and capabilities take 4 writes, so the 5th is the first message
+	ft := NewFaultTransport(network, Faults{Script: []Fault{{Conn: 1, Op: OpWrite, Call: 5, Kind: Corrupt}}})
+
+	s, c := faultPair(t, ft, network)
+
+	s.Write(5, []byte("corrupted"))
+
+	deadline := time.Now().Add(Timeout)
+	for c.Stats().DecryptionErrors == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the corrupted message should have failed to decrypt")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the connection carries on with the next message
+	s.Write(6, []byte("intact"))
+	ExpectMessage(t, c, 6, []byte("intact"))
+
+	if c.StatusCode() != ipc.Connected {
+		t.Error("the client should still be connected, got", c.Status())
+	}
+}
+
+func TestFaultPartial(t *testing.T) {
+
+	network := NewNetwork()
+
+	// every read and write on the client only handles part of the buffer
+	ft := NewFaultTransport(network, Faults{PartialRate: 1, Latency: time.Millisecond, Seed: 1})
+
+	s, c := faultPair(t, network, ft)
+
+	big := bytes.Repeat([]byte("partial"), 20000)
+
+	c.WriteMessage(&ipc.Message{MsgType: 5, Data: big, Headers: map[string]string{"k": "v"}})
+	if m := ExpectMessage(t, s, 5, big); m.Headers["k"] != "v" {
+		t.Error("headers should survive partial writes", m.Headers)
+	}
+
+	s.Write(6, big)
+	ExpectMessage(t, c, 6, big)
+
+	if len(ft.Injected()) == 0 {
+		t.Error("partial reads and writes should have been injected")
+	}
+}
+
+func TestFaultStall(t *testing.T) {
+
+	network := NewNetwork()
+
+	// the server never seems to answer the handshake
+	ft := NewFaultTransport(network, Faults{Script: []Fault{{Conn: 1, Op: OpRead, Call: 1, Kind: Stall}}})
+
+	s, err := ipc.NewServer("faults", ipc.WithTransport(network), ipc.WithSuppressStatus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c, err := ipc.NewClient("faults", ipc.WithTransport(ft), ipc.WithSuppressStatus())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ExpectStatus(t, c.Events(), ipc.Connecting)
+
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+
+	// closing the client ends the stalled read
+	c.Close()
+
+	if err := c.WaitForStatus(ctx, ipc.Closed); err != nil {
+		t.Error("the client should close while the handshake is stalled, got", c.Status())
+	}
+}
@@ -0,0 +1,129 @@
+// Package ipctest - an in-memory transport, fake clock and helpers for testing code that uses the ipc package,
+// without creating real sockets or sleeping.
+package ipctest
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// backlog - number of connections that can wait to be accepted, the server only accepts one client at a time
+const backlog = 16
+
+// Network - an in-memory ipc.Transport, servers and clients using the same Network connect through net.Pipe() by name
+type Network struct {
+	mutex     sync.Mutex
+	listeners map[string]*listener
+}
+
+// NewNetwork - returns an empty Network, pass it to both ends with ipc.WithTransport()
+func NewNetwork() *Network {
+
+	return &Network{listeners: make(map[string]*listener)}
+}
+
+// Listen - starts listening on name, only one server can listen on a name at a time
+func (n *Network) Listen(name string) (net.Listener, error) {
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if _, ok := n.listeners[name]; ok {
+		return nil, errors.New("name is already in use")
+	}
+
+	l := &listener{
+		network: n,
+		name:    name,
+		conns:   make(chan net.Conn, backlog),
+		done:    make(chan struct{}),
+	}
+
+	n.listeners[name] = l
+
+	return l, nil
+}
+
+// Dial - connects to the server listening on name, the connection waits in the backlog until the server accepts it
+func (n *Network) Dial(name string) (net.Conn, error) {
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	l, ok := n.listeners[name]
+	if !ok {
+		return nil, errors.New("no server is listening on " + name)
+	}
+
+	server, client := net.Pipe()
+
+	select {
+	case l.conns <- server:
+	default:
+		server.Close()
+		client.Close()
+		return nil, errors.New("backlog is full")
+	}
+
+	return client, nil
+}
+
+// listener - the net.Listener returned by Network.Listen()
+type listener struct {
+	network *Network
+	name    string
+	conns   chan net.Conn
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errors.New("listener has been closed")
+	}
+}
+
+// Close - stops listening, connections still waiting to be accepted are closed
+func (l *listener) Close() error {
+
+	l.once.Do(func() {
+
+		l.network.mutex.Lock()
+		delete(l.network.listeners, l.name)
+		l.network.mutex.Unlock()
+
+		close(l.done)
+
+		for {
+			select {
+			case conn := <-l.conns:
+				conn.Close()
+			default:
+				return
+			}
+		}
+	})
+
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+
+	return addr(l.name)
+}
+
+// addr - the name the server is listening on
+type addr string
+
+func (a addr) Network() string {
+	return "ipctest"
+}
+
+func (a addr) String() string {
+	return string(a)
+}
@@ -0,0 +1,80 @@
+package ipctest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ipc "github.com/james-barrow/golang-ipc"
+)
+
+// Timeout - how long NewPair() and the Expect helpers wait before failing the test
+var Timeout = 5 * time.Second
+
+// PairOption - configures the server or client started by NewPair()
+type PairOption func(*pair)
+
+type pair struct {
+	server []ipc.Option
+	client []ipc.Option
+}
+
+// ServerOptions - options passed to ipc.NewServer() by NewPair()
+func ServerOptions(opts ...ipc.Option) PairOption {
+
+	return func(p *pair) {
+		p.server = append(p.server, opts...)
+	}
+}
+
+// ClientOptions - options passed to ipc.NewClient() by NewPair()
+func ClientOptions(opts ...ipc.Option) PairOption {
+
+	return func(p *pair) {
+		p.client = append(p.client, opts...)
+	}
+}
+
+// NewPair - starts a server and a client connected over a new in-memory Network, and waits for both to be connected.
+// Status changes are only reported on Events(), so Read() just returns messages and errors.
+// Both are closed when the test finishes.
+func NewPair(t testing.TB, opts ...PairOption) (*ipc.Server, *ipc.Client) {
+
+	t.Helper()
+
+	network := NewNetwork()
+
+	p := &pair{
+		server: []ipc.Option{ipc.WithTransport(network), ipc.WithSuppressStatus()},
+		client: []ipc.Option{ipc.WithTransport(network), ipc.WithSuppressStatus()},
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	s, err := ipc.NewServer("ipctest", p.server...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+
+	c, err := ipc.NewClient("ipctest", p.client...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+
+	if err := c.WaitForStatus(ctx, ipc.Connected); err != nil {
+		t.Fatal("client didn't connect: ", err)
+	}
+
+	if err := s.WaitForStatus(ctx, ipc.Connected); err != nil {
+		t.Fatal("server didn't connect: ", err)
+	}
+
+	return s, c
+}
@@ -0,0 +1,220 @@
+package ipc
+
+import (
+	"sync"
+	"time"
+)
+
+// Metrics - hook that is called as messages and connections pass through the server or client.
+// Pass an implementation in ServerConfig.Metrics or ClientConfig.Metrics to collect them in your own system,
+// the same figures are always available from Stats().
+type Metrics interface {
+	MessageSent(msgType int, bytes int)     // a message has been written to the connection
+	MessageReceived(msgType int, bytes int) // a message has been read from the connection
+	MessageDropped(msgType int)             // a queued message was discarded before it was written
+	MessageExpired(msgType int)             // a message received after its deadline was discarded
+	EncryptionError()                       // a message could not be encrypted
+	DecryptionError()                       // a message received could not be decrypted
+	Handshake(duration time.Duration)       // a handshake has completed
+	ReconnectAttempt()                      // the client has tried to reconnect
+}
+
+// Stats - snapshot of the metrics collected on a server or client
+type Stats struct {
+	Sent              map[int]MsgStats // messages written, by message type
+	Received          map[int]MsgStats // messages read, by message type
+	Dropped           uint64           // queued messages discarded before they were written
+	Expired           uint64           // messages received after their deadline and discarded
+	EncryptionErrors  uint64
+	DecryptionErrors  uint64
+	Handshakes        uint64        // number of completed handshakes
+	HandshakeTime     time.Duration // total time spent in completed handshakes
+	ReconnectAttempts uint64
+	WriteQueue        int // messages waiting to be written
+}
+
+// MsgStats - count of messages and bytes for a single message type
+type MsgStats struct {
+	Messages uint64
+	Bytes    uint64
+}
+
+// stats - the default Metrics implementation, backs Stats()
+type stats struct {
+	mutex sync.Mutex
+	s     Stats
+}
+
+func newStats() *stats {
+
+	return &stats{
+		s: Stats{
+			Sent:     make(map[int]MsgStats),
+			Received: make(map[int]MsgStats),
+		},
+	}
+}
+
+func (st *stats) MessageSent(msgType int, bytes int) {
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	m := st.s.Sent[msgType]
+	m.Messages++
+	m.Bytes += uint64(bytes)
+	st.s.Sent[msgType] = m
+}
+
+func (st *stats) MessageReceived(msgType int, bytes int) {
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	m := st.s.Received[msgType]
+	m.Messages++
+	m.Bytes += uint64(bytes)
+	st.s.Received[msgType] = m
+}
+
+func (st *stats) MessageDropped(msgType int) {
+
+	st.mutex.Lock()
+	st.s.Dropped++
+	st.mutex.Unlock()
+}
+
+func (st *stats) MessageExpired(msgType int) {
+
+	st.mutex.Lock()
+	st.s.Expired++
+	st.mutex.Unlock()
+}
+
+func (st *stats) EncryptionError() {
+
+	st.mutex.Lock()
+	st.s.EncryptionErrors++
+	st.mutex.Unlock()
+}
+
+func (st *stats) DecryptionError() {
+
+	st.mutex.Lock()
+	st.s.DecryptionErrors++
+	st.mutex.Unlock()
+}
+
+func (st *stats) Handshake(duration time.Duration) {
+
+	st.mutex.Lock()
+	st.s.Handshakes++
+	st.s.HandshakeTime += duration
+	st.mutex.Unlock()
+}
+
+func (st *stats) ReconnectAttempt() {
+
+	st.mutex.Lock()
+	st.s.ReconnectAttempts++
+	st.mutex.Unlock()
+}
+
+// snapshot - copy of the stats that is safe to hand to the caller
+func (st *stats) snapshot() Stats {
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	s := st.s
+	s.Sent = make(map[int]MsgStats, len(st.s.Sent))
+	s.Received = make(map[int]MsgStats, len(st.s.Received))
+
+	for k, v := range st.s.Sent {
+		s.Sent[k] = v
+	}
+
+	for k, v := range st.s.Received {
+		s.Received[k] = v
+	}
+
+	return s
+}
+
+// multiMetrics - passes each metric to the built in stats and the user supplied hook
+type multiMetrics []Metrics
+
+func newMetrics(st *stats, hook Metrics) Metrics {
+
+	if hook == nil {
+		return st
+	}
+
+	return multiMetrics{st, hook}
+}
+
+func (mm multiMetrics) MessageSent(msgType int, bytes int) {
+	for _, m := range mm {
+		m.MessageSent(msgType, bytes)
+	}
+}
+
+func (mm multiMetrics) MessageReceived(msgType int, bytes int) {
+	for _, m := range mm {
+		m.MessageReceived(msgType, bytes)
+	}
+}
+
+func (mm multiMetrics) MessageDropped(msgType int) {
+	for _, m := range mm {
+		m.MessageDropped(msgType)
+	}
+}
+
+func (mm multiMetrics) MessageExpired(msgType int) {
+	for _, m := range mm {
+		m.MessageExpired(msgType)
+	}
+}
+
+func (mm multiMetrics) EncryptionError() {
+	for _, m := range mm {
+		m.EncryptionError()
+	}
+}
+
+func (mm multiMetrics) DecryptionError() {
+	for _, m := range mm {
+		m.DecryptionError()
+	}
+}
+
+func (mm multiMetrics) Handshake(duration time.Duration) {
+	for _, m := range mm {
+		m.Handshake(duration)
+	}
+}
+
+func (mm multiMetrics) ReconnectAttempt() {
+	for _, m := range mm {
+		m.ReconnectAttempt()
+	}
+}
+
+// Stats - returns a snapshot of the metrics collected by the server
+func (s *Server) Stats() Stats {
+
+	st := s.stats.snapshot()
+	st.WriteQueue = len(s.toWriteHigh) + len(s.toWrite) + len(s.toWriteLow)
+
+	return st
+}
+
+// Stats - returns a snapshot of the metrics collected by the client
+func (c *Client) Stats() Stats {
+
+	st := c.stats.snapshot()
+	st.WriteQueue = len(c.toWriteHigh) + len(c.toWrite) + len(c.toWriteLow)
+
+	return st
+}
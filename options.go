@@ -0,0 +1,509 @@
+package ipc
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/james-barrow/golang-ipc/wire"
+)
+
+// Option - configures a server or client started with NewServer() or NewClient().
+// Invalid values are reported as an error by NewServer() or NewClient() instead of being replaced with a default.
+type Option func(*options) error
+
+// options - the settings shared by ServerConfig, ClientConfig and the With... options
+type options struct {
+	maxMsgSize   int
+	encryption   bool
+	unmask       bool
+	noStatus     bool
+	metrics      Metrics
+	tracer       Tracer
+	writeBuffer  int
+	writePolicy  WritePolicy
+	maxBatch     int
+	batchLatency time.Duration
+	shmSize      int
+	shm          bool
+	onExpired    func(*Message)
+	timeout      time.Duration
+	retryTimer   time.Duration
+	reconnect    ReconnectPolicy
+	noReconnect  bool
+	clientID     string
+	transport    Transport
+	clock        Clock
+	recorder     Recorder
+	service      string
+	version      string
+	registryDir  string
+	activation   bool
+
+	serverOnly []string // names of the options given that only apply to a server
+	clientOnly []string // names of the options given that only apply to a client
+}
+
+func defaultOptions() *options {
+
+	return &options{
+		maxMsgSize:  maxMsgSize,
+		encryption:  true,
+		maxBatch:    maxBatch,
+		retryTimer:  retryTimer,
+		registryDir: registryDir,
+	}
+}
+
+// WithMaxMsgSize - the largest message, in bytes, the server and client can write. Server only, at least 1024 and at most 1Gb (default is 3145728 / 3Mb)
+func WithMaxMsgSize(size int) Option {
+
+	return func(o *options) error {
+		if size < 1024 {
+			return errors.New("max message size must be at least 1024 bytes")
+		}
+		if size > wire.MaxMsgSizeCap {
+			return errors.New("max message size can't be more than 1Gb")
+		}
+		o.maxMsgSize = size
+		o.serverOnly = append(o.serverOnly, "WithMaxMsgSize")
+		return nil
+	}
+}
+
+// WithEncryption - whether the server encrypts the connection, or whether the client insists on it (default is true)
+func WithEncryption(encryption bool) Option {
+
+	return func(o *options) error {
+		o.encryption = encryption
+		return nil
+	}
+}
+
+// WithUnmaskPermissions - makes the socket writeable for other users. Server only
+func WithUnmaskPermissions() Option {
+
+	return func(o *options) error {
+		o.unmask = true
+		o.serverOnly = append(o.serverOnly, "WithUnmaskPermissions")
+		return nil
+	}
+}
+
+// WithSuppressStatus - stops status changes being returned by Read(), use Events() instead
+func WithSuppressStatus() Option {
+
+	return func(o *options) error {
+		o.noStatus = true
+		return nil
+	}
+}
+
+// WithMetrics - hook called for each message sent/received, handshake, error etc
+func WithMetrics(metrics Metrics) Option {
+
+	return func(o *options) error {
+		o.metrics = metrics
+		return nil
+	}
+}
+
+// WithRecorder - hook called for each message sent and received, and each status change, e.g. the record package writes them to a file
+func WithRecorder(recorder Recorder) Option {
+
+	return func(o *options) error {
+		if recorder == nil {
+			return errors.New("recorder can't be nil")
+		}
+		o.recorder = recorder
+		return nil
+	}
+}
+
+// WithService - announces the server in the registry as speaking protocol, so clients can find it with ListServers() or NewServiceClient().
+// The entry is removed when the server is closed, or by ListServers() if the process exits without closing it. Server only
+func WithService(protocol, version string) Option {
+
+	return func(o *options) error {
+		if protocol == "" {
+			return errors.New("service protocol can't be empty")
+		}
+		o.service = protocol
+		o.version = version
+		o.serverOnly = append(o.serverOnly, "WithService")
+		return nil
+	}
+}
+
+// WithRegistryDir - the directory of the registry, e.g. so tests don't see other servers (default is /tmp/golang-ipc-<uid>, or golang-ipc in the temp directory on windows)
+func WithRegistryDir(dir string) Option {
+
+	return func(o *options) error {
+		if dir == "" {
+			return errors.New("registry directory can't be empty")
+		}
+		o.registryDir = dir
+		return nil
+	}
+}
+
+// WithTracer - moves trace context between a context.Context and the messages (default uses ContextWithTrace())
+func WithTracer(tracer Tracer) Option {
+
+	return func(o *options) error {
+		o.tracer = tracer
+		return nil
+	}
+}
+
+// WithWriteBuffer - number of messages Write() can queue, for each priority, before the write policy applies (default is 0, unbuffered)
+func WithWriteBuffer(size int) Option {
+
+	return func(o *options) error {
+		if size < 0 {
+			return errors.New("write buffer can't be negative")
+		}
+		o.writeBuffer = size
+		return nil
+	}
+}
+
+// WithWritePolicy - what Write() does when the write buffer is full (default is WriteBlock)
+func WithWritePolicy(policy WritePolicy) Option {
+
+	return func(o *options) error {
+		if policy != WriteBlock && policy != WriteFailFast && policy != WriteDropOldest {
+			return fmt.Errorf("unknown write policy %d", policy)
+		}
+		o.writePolicy = policy
+		return nil
+	}
+}
+
+// WithMaxBatch - most queued messages written in a single flush (default is 64)
+func WithMaxBatch(messages int) Option {
+
+	return func(o *options) error {
+		if messages < 1 {
+			return errors.New("max batch must be at least 1")
+		}
+		o.maxBatch = messages
+		return nil
+	}
+}
+
+// WithBatchLatency - how long the writer waits for more messages before flushing (default is 0, don't wait)
+func WithBatchLatency(latency time.Duration) Option {
+
+	return func(o *options) error {
+		if latency < 0 {
+			return errors.New("batch latency can't be negative")
+		}
+		o.batchLatency = latency
+		return nil
+	}
+}
+
+// WithSharedMemory - offers clients that ask for it shared memory rings of size bytes, linux only. Server only
+func WithSharedMemory(size int) Option {
+
+	return func(o *options) error {
+		if !sharedMemorySupported() {
+			return errors.New("shared memory is only supported on linux")
+		}
+		if size < minSharedMemory {
+			return fmt.Errorf("shared memory must be at least %d bytes", minSharedMemory)
+		}
+		o.shmSize = size
+		o.serverOnly = append(o.serverOnly, "WithSharedMemory")
+		return nil
+	}
+}
+
+// WithSocketActivation - listens on the unix socket passed by systemd in LISTEN_FDS instead of creating one, linux only. Server only.
+// The socket is picked by its FileDescriptorName=, which should be the name of the server, or if only one is passed it's used whatever it's called
+func WithSocketActivation() Option {
+
+	return func(o *options) error {
+		if !socketActivationSupported() {
+			return errors.New("socket activation is only supported on linux")
+		}
+		o.activation = true
+		o.serverOnly = append(o.serverOnly, "WithSocketActivation")
+		return nil
+	}
+}
+
+// WithRequestSharedMemory - asks the server to send messages through shared memory instead of the socket, linux only. Client only
+func WithRequestSharedMemory() Option {
+
+	return func(o *options) error {
+		if !sharedMemorySupported() {
+			return errors.New("shared memory is only supported on linux")
+		}
+		o.shm = true
+		o.clientOnly = append(o.clientOnly, "WithRequestSharedMemory")
+		return nil
+	}
+}
+
+// WithOnExpired - called with each message received after its deadline, before it is discarded
+func WithOnExpired(f func(*Message)) Option {
+
+	return func(o *options) error {
+		o.onExpired = f
+		return nil
+	}
+}
+
+// WithTimeout - how long the client keeps trying to connect or reconnect before giving up. Client only (default is 0, no timeout)
+func WithTimeout(timeout time.Duration) Option {
+
+	return func(o *options) error {
+		if timeout < 0 {
+			return errors.New("timeout can't be negative")
+		}
+		o.timeout = timeout
+		o.clientOnly = append(o.clientOnly, "WithTimeout")
+		return nil
+	}
+}
+
+// WithRetryTimer - how long the client waits between attempts to connect. Client only (default is 20 seconds)
+func WithRetryTimer(wait time.Duration) Option {
+
+	return func(o *options) error {
+		if wait <= 0 {
+			return errors.New("retry timer must be more than 0")
+		}
+		o.retryTimer = wait
+		o.clientOnly = append(o.clientOnly, "WithRetryTimer")
+		return nil
+	}
+}
+
+// WithReconnectPolicy - how long the client waits between attempts to connect, and when it gives up. Client only (default is ConstantBackoff with the retry timer)
+func WithReconnectPolicy(policy ReconnectPolicy) Option {
+
+	return func(o *options) error {
+		if policy == nil {
+			return errors.New("reconnect policy can't be nil")
+		}
+		o.reconnect = policy
+		o.clientOnly = append(o.clientOnly, "WithReconnectPolicy")
+		return nil
+	}
+}
+
+// WithoutReconnect - the client moves to Disconnected instead of reconnecting when the connection is lost. Client only
+func WithoutReconnect() Option {
+
+	return func(o *options) error {
+		o.noReconnect = true
+		o.clientOnly = append(o.clientOnly, "WithoutReconnect")
+		return nil
+	}
+}
+
+// WithClientID - the ID sent to the server each time the client connects, so the server can tell it's the same client. Client only, up to 256 bytes
+// (default is a random ID that lasts as long as the client)
+func WithClientID(id string) Option {
+
+	return func(o *options) error {
+		if err := validClientID(id); err != nil {
+			return err
+		}
+		o.clientID = id
+		o.clientOnly = append(o.clientOnly, "WithClientID")
+		return nil
+	}
+}
+
+// WithTransport - listen or connect with transport instead of the unix socket or named pipe, e.g. the in-memory transport in the ipctest package
+func WithTransport(transport Transport) Option {
+
+	return func(o *options) error {
+		if transport == nil {
+			return errors.New("transport can't be nil")
+		}
+		o.transport = transport
+		return nil
+	}
+}
+
+// WithClock - the clock used for the timeout, reconnect policy and message deadlines. Client only (default is the system clock)
+func WithClock(clock Clock) Option {
+
+	return func(o *options) error {
+		if clock == nil {
+			return errors.New("clock can't be nil")
+		}
+		o.clock = clock
+		o.clientOnly = append(o.clientOnly, "WithClock")
+		return nil
+	}
+}
+
+// apply - applies the options in order, then checks they make sense together
+func (o *options) apply(opts []Option, server bool) error {
+
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return err
+		}
+	}
+
+	if server && len(o.clientOnly) > 0 {
+		return fmt.Errorf("%s can only be used with a client", o.clientOnly[0])
+	}
+
+	if !server && len(o.serverOnly) > 0 {
+		return fmt.Errorf("%s can only be used with a server", o.serverOnly[0])
+	}
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+
+	if o.writePolicy == WriteDropOldest && o.writeBuffer == 0 {
+		return errors.New("WriteDropOldest needs a write buffer, see WithWriteBuffer")
+	}
+
+	return nil
+}
+
+// validate - checks the settings that depend on each other or on the platform, whether they came from options or a config
+func (o *options) validate() error {
+
+	if (o.shm || o.shmSize > 0) && !sharedMemorySupported() {
+		return errors.New("shared memory is only supported on linux")
+	}
+
+	if o.activation && !socketActivationSupported() {
+		return errors.New("socket activation is only supported on linux")
+	}
+
+	if o.transport != nil && (o.shm || o.shmSize > 0) {
+		return errors.New("shared memory can't be used with a transport")
+	}
+
+	if o.transport != nil && o.activation {
+		return errors.New("socket activation can't be used with a transport")
+	}
+
+	if o.clientID != "" {
+		if err := validClientID(o.clientID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// options - the settings from the config, values that are out of range are replaced with the defaults as they always have been
+func (config *ServerConfig) options() *options {
+
+	o := defaultOptions()
+
+	if config == nil {
+		return o
+	}
+
+	if config.MaxMsgSize >= 1024 {
+		o.maxMsgSize = config.MaxMsgSize
+	}
+
+	if o.maxMsgSize > wire.MaxMsgSizeCap {
+		o.maxMsgSize = wire.MaxMsgSizeCap
+	}
+
+	o.encryption = config.Encryption
+	o.unmask = config.UnmaskPermissions
+	o.noStatus = config.SuppressStatus
+	o.metrics = config.Metrics
+	o.tracer = config.Tracer
+
+	if config.WriteBuffer > 0 {
+		o.writeBuffer = config.WriteBuffer
+	}
+
+	o.writePolicy = config.WritePolicy
+
+	if config.MaxBatch > 0 {
+		o.maxBatch = config.MaxBatch
+	}
+
+	o.batchLatency = config.BatchLatency
+	o.onExpired = config.OnExpired
+	o.transport = config.Transport
+	o.recorder = config.Recorder
+	o.activation = config.SocketActivation
+	o.service = config.Service
+	o.version = config.ServiceVersion
+
+	if config.RegistryDir != "" {
+		o.registryDir = config.RegistryDir
+	}
+
+	if config.SharedMemory > 0 {
+		if config.SharedMemory < minSharedMemory {
+			o.shmSize = minSharedMemory
+		} else {
+			o.shmSize = config.SharedMemory
+		}
+	}
+
+	return o
+}
+
+// options - the settings from the config, values that are out of range are replaced with the defaults as they always have been
+func (config *ClientConfig) options() *options {
+
+	o := defaultOptions()
+
+	if config == nil {
+		return o
+	}
+
+	// Timeout is in seconds and RetryTimer is a number of seconds
+	if config.Timeout > 0 {
+		o.timeout = time.Duration(config.Timeout * float64(time.Second))
+	}
+
+	if config.RetryTimer < 1 {
+		o.retryTimer = time.Second
+	} else {
+		o.retryTimer = config.RetryTimer * time.Second
+	}
+
+	o.encryption = config.Encryption
+	o.noStatus = config.SuppressStatus
+	o.metrics = config.Metrics
+	o.tracer = config.Tracer
+
+	if config.WriteBuffer > 0 {
+		o.writeBuffer = config.WriteBuffer
+	}
+
+	o.writePolicy = config.WritePolicy
+
+	if config.MaxBatch > 0 {
+		o.maxBatch = config.MaxBatch
+	}
+
+	o.batchLatency = config.BatchLatency
+	o.onExpired = config.OnExpired
+	o.shm = config.SharedMemory
+	o.reconnect = config.ReconnectPolicy
+	o.noReconnect = config.DisableReconnect
+	o.clientID = config.ClientID
+	o.transport = config.Transport
+	o.clock = config.Clock
+	o.recorder = config.Recorder
+
+	if config.RegistryDir != "" {
+		o.registryDir = config.RegistryDir
+	}
+
+	return o
+}
@@ -0,0 +1,199 @@
+package ipc
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/james-barrow/golang-ipc/wire"
+)
+
+// Priority - the order queued messages are written in, higher priority messages are written first.
+// Large messages below PriorityHigh are split into chunks so higher priority messages can be written in between.
+type Priority int
+
+const (
+	PriorityLow Priority = iota - 1
+	PriorityNormal
+	PriorityHigh
+)
+
+const numLanes = 3
+
+// chunkSize - messages with more data than this are split up, unless they are PriorityHigh
+const chunkSize = 64 * 1024
+
+// lane - the index of the outbound queue for the priority, 0 is written first
+func (p Priority) lane() int {
+
+	switch {
+	case p >= PriorityHigh:
+		return 0
+	case p <= PriorityLow:
+		return 2
+	}
+
+	return 1
+}
+
+// lanes - the outbound queues and the messages part way through being written in chunks
+type lanes struct {
+	queues  [numLanes]chan *Message
+	pending [numLanes]*Message
+	offset  [numLanes]int
+	metrics Metrics
+	clock   Clock // decides which messages have expired
+}
+
+func newLanes(high, normal, low chan *Message, metrics Metrics, clock Clock) *lanes {
+
+	return &lanes{queues: [numLanes]chan *Message{high, normal, low}, metrics: metrics, clock: clock}
+}
+
+// next - the highest priority message waiting to be written, or nil if there isn't one.
+// A queued message of higher priority comes before the rest of a message being written in chunks,
+// messages that have expired while they were queued are dropped.
+// Returns false if a queue has been closed.
+func (l *lanes) next() (*Message, bool) {
+
+	for i := 0; i < numLanes; i++ {
+
+		if l.pending[i] != nil {
+			return l.pending[i], true
+		}
+
+		select {
+		case m, ok := <-l.queues[i]:
+			if !ok {
+				return nil, false
+			}
+			if m = unexpired(m, l.metrics, l.clock.Now()); m == nil {
+				i-- // try the same queue again
+				continue
+			}
+			return m, true
+		default:
+		}
+	}
+
+	return nil, true
+}
+
+// wait - blocks until a message is queued, done is closed or the timeout passes (nil if so)
+func (l *lanes) wait(done chan struct{}, timeout <-chan time.Time) (*Message, bool) {
+
+	if m, ok := l.next(); m != nil || !ok {
+		return m, ok
+	}
+
+	var m *Message
+	var ok bool
+
+	select {
+	case m, ok = <-l.queues[0]:
+	case m, ok = <-l.queues[1]:
+	case m, ok = <-l.queues[2]:
+	case <-done:
+		return nil, true
+	case <-timeout:
+		return nil, true
+	}
+
+	if !ok {
+		return nil, false
+	}
+
+	if m = unexpired(m, l.metrics, l.clock.Now()); m == nil {
+		return l.wait(done, timeout)
+	}
+
+	return m, true
+}
+
+// encode - appends the frames for the message to dst, or the frames for its next chunk if it is being split up.
+// Returns true once the whole message has been encoded.
+func (l *lanes) encode(sess *session, dst []byte, m *Message) ([]byte, bool, error) {
+
+	lane := m.Priority.lane()
+
+	if lane == 0 || len(m.Data) <= chunkSize || m.batch != nil || len(m.Files) > 0 || sess.caps()&capChunks == 0 {
+		b, err := sess.encode(dst, m)
+		return b, true, err
+	}
+
+	start := l.offset[lane]
+	end := start + chunkSize
+	last := end >= len(m.Data)
+
+	if last {
+		end = len(m.Data)
+		l.pending[lane] = nil
+		l.offset[lane] = 0
+	} else {
+		l.pending[lane] = m
+		l.offset[lane] = end
+	}
+
+	var err error
+
+	// the headers go with the last chunk, another message may be written between the chunks
+	if headers := m.frameHeaders(); last && headers != nil && sess.caps()&capHeaders != 0 {
+		dst, err = appendHeadersFrame(dst, sess.cipher, headers)
+		if err != nil {
+			return nil, last, err
+		}
+	}
+
+	buf := getBuffer(0)
+	chunk := wire.AppendChunk(*buf, wire.Chunk{Lane: lane, Last: last, MsgType: m.MsgType, Data: m.Data[start:end]})
+
+	dst, err = wire.AppendFrame(dst, sess.cipher, 0, chunk)
+
+	*buf = chunk
+	putBuffer(buf)
+
+	return dst, last, err
+}
+
+// addChunk - adds a chunk received to the message being put together for its lane.
+// Returns the message type and data once the last chunk has arrived.
+func (sess *session) addChunk(data []byte, maxMsgSize int) (int, []byte, error) {
+
+	c, err := wire.ParseChunk(data)
+	if err != nil || c.Lane >= numLanes {
+		return 0, nil, errors.New("invalid message chunk")
+	}
+
+	lane := c.Lane
+
+	if len(sess.chunks[lane])+len(c.Data) > maxMsgSize {
+		sess.chunks[lane] = nil
+		return 0, nil, errors.New("chunked message exceeds maximum message length")
+	}
+
+	sess.chunks[lane] = append(sess.chunks[lane], c.Data...)
+
+	if !c.Last {
+		return 0, nil, nil
+	}
+
+	msg := sess.chunks[lane]
+	sess.chunks[lane] = nil
+
+	if msg == nil {
+		msg = []byte{}
+	}
+
+	return c.MsgType, msg, nil
+}
+
+// caps - the capabilities of the other end, the client only learns the server's once it has been connected
+func (sess *session) caps() byte {
+
+	return byte(atomic.LoadUint32(&sess.peerCaps))
+}
+
+func (sess *session) setCaps(caps byte) {
+
+	atomic.StoreUint32(&sess.peerCaps, uint32(caps))
+}
@@ -0,0 +1,100 @@
+package ipc
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// StatsProvider - implemented by both Server and Client
+type StatsProvider interface {
+	Stats() Stats
+}
+
+// PrometheusHandler - returns an http.Handler that writes the stats of each connection in the Prometheus text format.
+// connections - the key is used as the "ipc" label on every metric, e.g. the name passed to StartServer.
+func PrometheusHandler(connections map[string]StatsProvider) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		names := make([]string, 0, len(connections))
+		for name := range connections {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		all := make([]Stats, len(names))
+		for i, name := range names {
+			all[i] = connections[name].Stats()
+		}
+
+		writePrometheus(w, names, all)
+	})
+}
+
+func writePrometheus(w io.Writer, names []string, all []Stats) {
+
+	perType := func(metric, help string, get func(Stats) map[int]MsgStats, bytes bool) {
+
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", metric, help, metric)
+
+		for i, name := range names {
+
+			m := get(all[i])
+
+			types := make([]int, 0, len(m))
+			for t := range m {
+				types = append(types, t)
+			}
+			sort.Ints(types)
+
+			for _, t := range types {
+				v := m[t].Messages
+				if bytes {
+					v = m[t].Bytes
+				}
+				fmt.Fprintf(w, "%s{ipc=%s,msg_type=\"%d\"} %d\n", metric, labelValue(name), t, v)
+			}
+		}
+	}
+
+	single := func(metric, help, kind string, get func(Stats) string) {
+
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric, help, metric, kind)
+
+		for i, name := range names {
+			fmt.Fprintf(w, "%s{ipc=%s} %s\n", metric, labelValue(name), get(all[i]))
+		}
+	}
+
+	sent := func(s Stats) map[int]MsgStats { return s.Sent }
+	received := func(s Stats) map[int]MsgStats { return s.Received }
+
+	perType("ipc_messages_sent_total", "Messages written to the connection.", sent, false)
+	perType("ipc_bytes_sent_total", "Bytes of message data written to the connection.", sent, true)
+	perType("ipc_messages_received_total", "Messages read from the connection.", received, false)
+	perType("ipc_bytes_received_total", "Bytes of message data read from the connection.", received, true)
+
+	single("ipc_messages_dropped_total", "Queued messages discarded before they were written.", "counter", func(s Stats) string { return strconv.FormatUint(s.Dropped, 10) })
+	single("ipc_messages_expired_total", "Messages received after their deadline and discarded.", "counter", func(s Stats) string { return strconv.FormatUint(s.Expired, 10) })
+	single("ipc_encryption_errors_total", "Messages that could not be encrypted.", "counter", func(s Stats) string { return strconv.FormatUint(s.EncryptionErrors, 10) })
+	single("ipc_decryption_errors_total", "Messages received that could not be decrypted.", "counter", func(s Stats) string { return strconv.FormatUint(s.DecryptionErrors, 10) })
+	single("ipc_handshakes_total", "Completed handshakes.", "counter", func(s Stats) string { return strconv.FormatUint(s.Handshakes, 10) })
+	single("ipc_handshake_seconds_total", "Total time spent in completed handshakes.", "counter", func(s Stats) string { return strconv.FormatFloat(s.HandshakeTime.Seconds(), 'g', -1, 64) })
+	single("ipc_reconnect_attempts_total", "Attempts made by the client to reconnect.", "counter", func(s Stats) string { return strconv.FormatUint(s.ReconnectAttempts, 10) })
+	single("ipc_write_queue_depth", "Messages waiting to be written.", "gauge", func(s Stats) string { return strconv.Itoa(s.WriteQueue) })
+}
+
+// labelEscaper - the text format only escapes backslash, double quote and newline in label values, anything else is written as it is
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue - the quoted label value
+func labelValue(v string) string {
+
+	return `"` + labelEscaper.Replace(v) + `"`
+}
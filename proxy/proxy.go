@@ -0,0 +1,297 @@
+// Package proxy - sits between an ipc client and server so the messages they send each other can be inspected.
+// The proxy listens on one name and connects to the server on another, each side has its own handshake, so the
+// messages are seen decrypted even when both sides use encryption. Messages can be logged, delayed, dropped or changed.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	ipc "github.com/james-barrow/golang-ipc"
+)
+
+// maxLogData - most bytes of each message written to the log
+const maxLogData = 256
+
+// Direction - which way a message is going through the proxy
+type Direction int
+
+const (
+	// ClientToServer - received from the client connected to the proxy, sent on to the server
+	ClientToServer Direction = iota
+	// ServerToClient - received from the server, sent on to the client connected to the proxy
+	ServerToClient
+)
+
+func (d Direction) String() string {
+
+	if d == ServerToClient {
+		return "server->client"
+	}
+
+	return "client->server"
+}
+
+// Record - a message that passed through the proxy
+type Record struct {
+	Time      time.Time // when the proxy received the message
+	Direction Direction
+	MsgType   int
+	Headers   map[string]string
+	Data      []byte
+	Delay     time.Duration // how long the message was held before being sent on
+	Dropped   bool          // the message wasn't sent on, see Config.DropRate and Config.Intercept
+	Err       error         // why the message couldn't be sent on, e.g. the other side isn't connected
+}
+
+// Config - used to pass configuation overrides to Start()
+type Config struct {
+	Log      io.Writer     // each message and connection change is written as a line of text (default is nil, don't log)
+	OnRecord func(Record)  // called with each message once it has been sent on or dropped (default is nil)
+	Delay    time.Duration // how long each message is held before being sent on, messages going the same way stay in order (default is 0)
+	Jitter   time.Duration // up to this much is randomly added to Delay (default is 0)
+	DropRate float64       // fraction of messages, 0 to 1, that are dropped instead of being sent on (default is 0)
+
+	// Intercept - called with each message before it is sent on, return nil to drop it or a different message to send instead (default is nil)
+	Intercept func(Direction, *ipc.Message) *ipc.Message
+
+	ServerOptions []ipc.Option // options for the server the client connects to, e.g. ipc.WithEncryption(false)
+	ClientOptions []ipc.Option // options for the client that connects to the server
+}
+
+// Proxy - a running proxy, see Start()
+type Proxy struct {
+	server *ipc.Server // the client connects to this
+	client *ipc.Client // this connects to the server
+	config Config
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	mutex  sync.Mutex // guards writes to the log
+}
+
+// Start - listens on listenName and connects to the server on upstreamName.
+// The client connecting to the proxy doesn't need to change anything other than the name. Status changes are written to the log
+// instead of being passed on, and each client connecting to the proxy shares the same connection to the server.
+// config - can be nil for the defaults.
+func Start(listenName, upstreamName string, config *Config) (*Proxy, error) {
+
+	p := &Proxy{}
+	if config != nil {
+		p.config = *config
+	}
+
+	if p.config.DropRate < 0 || p.config.DropRate > 1 {
+		return nil, errors.New("drop rate must be between 0 and 1")
+	}
+
+	// statuses are logged from Events(), so Read() only returns messages
+	serverOpts := append([]ipc.Option{ipc.WithSuppressStatus()}, p.config.ServerOptions...)
+	clientOpts := append([]ipc.Option{ipc.WithSuppressStatus()}, p.config.ClientOptions...)
+
+	server, err := ipc.NewServer(listenName, serverOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := ipc.NewClient(upstreamName, clientOpts...)
+	if err != nil {
+		server.Close()
+		return nil, err
+	}
+
+	p.server = server
+	p.client = client
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+
+	go p.events("client", server.Events())
+	go p.events("server", client.Events())
+
+	go p.forward(ClientToServer, server.Read, client)
+	go p.forward(ServerToClient, client.Read, server)
+
+	return p, nil
+}
+
+// Close - closes both connections
+func (p *Proxy) Close() {
+
+	p.cancel()
+	p.server.Close()
+	p.client.Close()
+}
+
+// Server - the server the client connects to
+func (p *Proxy) Server() *ipc.Server {
+	return p.server
+}
+
+// Client - the client connected to the server
+func (p *Proxy) Client() *ipc.Client {
+	return p.client
+}
+
+// writer - the other side of the proxy, ipc.Server or ipc.Client
+type writer interface {
+	WriteMessage(*ipc.Message) error
+	WaitForStatus(context.Context, ipc.Status) error
+}
+
+// forward - sends on each message read until the proxy is closed.
+// If the other side isn't connected the message waits until it is, so nothing is lost while the server restarts.
+func (p *Proxy) forward(dir Direction, read func() (*ipc.Message, error), to writer) {
+
+	for {
+		m, err := read()
+		if err != nil {
+			if p.ctx.Err() != nil {
+				return
+			}
+			p.logf("%s error: %s", dir, err)
+			if dir == ServerToClient {
+				return // the client has given up
+			}
+			continue
+		}
+
+		if m.MsgType < 1 {
+			continue
+		}
+
+		r := Record{Time: time.Now(), Direction: dir, MsgType: m.MsgType, Headers: m.Headers, Data: m.Data}
+
+		if p.config.Intercept != nil {
+			m = p.config.Intercept(dir, m)
+		}
+
+		if m == nil || (p.config.DropRate > 0 && rand.Float64() < p.config.DropRate) {
+			r.Dropped = true
+			p.record(r)
+			continue
+		}
+
+		r.Delay = p.delay()
+
+		if r.Delay > 0 {
+			select {
+			case <-time.After(r.Delay):
+			case <-p.ctx.Done():
+				return
+			}
+		}
+
+		if err := to.WaitForStatus(p.ctx, ipc.Connected); err != nil {
+			return
+		}
+
+		r.Err = to.WriteMessage(&ipc.Message{MsgType: m.MsgType, Data: m.Data, Headers: m.Headers, Priority: m.Priority})
+		p.record(r)
+	}
+}
+
+// delay - Delay plus the jitter
+func (p *Proxy) delay() time.Duration {
+
+	d := p.config.Delay
+	if p.config.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(p.config.Jitter)))
+	}
+
+	return d
+}
+
+// record - logs the message and passes it to OnRecord
+func (p *Proxy) record(r Record) {
+
+	if p.config.Log != nil {
+
+		line := fmt.Sprintf("%s type=%d len=%d", r.Direction, r.MsgType, len(r.Data))
+
+		if len(r.Headers) > 0 {
+			line += " " + headerString(r.Headers)
+		}
+
+		if r.Delay > 0 {
+			line += fmt.Sprintf(" delay=%s", r.Delay)
+		}
+
+		switch {
+		case r.Dropped:
+			line += " dropped"
+		case r.Err != nil:
+			line += fmt.Sprintf(" error=%q", r.Err)
+		}
+
+		data := r.Data
+		if len(data) > maxLogData {
+			data = data[:maxLogData]
+		}
+		line += fmt.Sprintf(" %q", data)
+
+		p.logAt(r.Time, line)
+	}
+
+	if p.config.OnRecord != nil {
+		p.config.OnRecord(r)
+	}
+}
+
+// events - logs the connection changes of one side until the proxy is closed
+func (p *Proxy) events(side string, events <-chan ipc.Event) {
+
+	for {
+		select {
+		case e := <-events:
+			switch {
+			case e.Err != nil:
+				p.logf("%s error: %s", side, e.Err)
+			case e.Attempt > 0:
+			case e.Status == ipc.Connected && e.Peer != nil:
+				p.logf("%s connected, encryption %t, max message size %d", side, e.Peer.Encryption, e.Peer.MaxMsgSize)
+			default:
+				p.logf("%s %s", side, e.Status.String())
+			}
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *Proxy) logf(format string, args ...interface{}) {
+
+	if p.config.Log != nil {
+		p.logAt(time.Now(), fmt.Sprintf(format, args...))
+	}
+}
+
+func (p *Proxy) logAt(t time.Time, line string) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	fmt.Fprintf(p.config.Log, "%s %s\n", t.UTC().Format("2006-01-02T15:04:05.000000Z"), line)
+}
+
+// headerString - key=value pairs sorted by key
+func headerString(headers map[string]string) string {
+
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + "=" + headers[k]
+	}
+
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ipc "github.com/james-barrow/golang-ipc"
+	"github.com/james-barrow/golang-ipc/ipctest"
+)
+
+// syncBuffer - a bytes.Buffer that can be written by the proxy while the test reads it
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.buf.String()
+}
+
+// start - a server, a proxy in front of it and a client connected to the proxy, all over the same in-memory network
+func start(t *testing.T, config *Config) (*ipc.Server, *Proxy, *ipc.Client) {
+
+	t.Helper()
+
+	network := ipctest.NewNetwork()
+
+	s, err := ipc.NewServer("upstream", ipc.WithTransport(network), ipc.WithSuppressStatus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+
+	if config == nil {
+		config = &Config{}
+	}
+	config.ServerOptions = append(config.ServerOptions, ipc.WithTransport(network))
+	config.ClientOptions = append(config.ClientOptions, ipc.WithTransport(network), ipc.WithRetryTimer(10*time.Millisecond))
+
+	p, err := Start("proxy", "upstream", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+
+	c, err := ipc.NewClient("proxy", ipc.WithTransport(network), ipc.WithSuppressStatus(), ipc.WithRetryTimer(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), ipctest.Timeout)
+	defer cancel()
+
+	if err := s.WaitForStatus(ctx, ipc.Connected); err != nil {
+		t.Fatal("server didn't connect to the proxy")
+	}
+
+	if err := c.WaitForStatus(ctx, ipc.Connected); err != nil {
+		t.Fatal("client didn't connect to the proxy")
+	}
+
+	return s, p, c
+}
+
+func TestProxy(t *testing.T) {
+
+	log := &syncBuffer{}
+
+	var mutex sync.Mutex
+	var records []Record
+
+	s, _, c := start(t, &Config{
+		Log: log,
+		OnRecord: func(r Record) {
+			mutex.Lock()
+			records = append(records, r)
+			mutex.Unlock()
+		},
+	})
+
+	c.WriteMessage(&ipc.Message{MsgType: 5, Data: []byte("ping"), Headers: map[string]string{"k": "v"}})
+
+	m := ipctest.ExpectMessage(t, s, 5, []byte("ping"))
+	if m.Headers["k"] != "v" {
+		t.Errorf("expected the headers to be passed on, got %v", m.Headers)
+	}
+
+	s.Write(6, []byte("pong"))
+	ipctest.ExpectMessage(t, c, 6, []byte("pong"))
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if len(records) != 2 || records[0].Direction != ClientToServer || records[1].Direction != ServerToClient || records[1].MsgType != 6 {
+		t.Errorf("unexpected records %+v", records)
+	}
+
+	if !strings.Contains(log.String(), `client->server type=5 len=4 k=v "ping"`) || !strings.Contains(log.String(), `server->client type=6 len=4 "pong"`) {
+		t.Errorf("unexpected log %s", log.String())
+	}
+
+	if !strings.Contains(log.String(), "client connected, encryption true") {
+		t.Errorf("expected the client connecting to be logged, got %s", log.String())
+	}
+}
+
+func TestProxyIntercept(t *testing.T) {
+
+	log := &syncBuffer{}
+
+	s, _, c := start(t, &Config{
+		Log: log,
+		Intercept: func(dir Direction, m *ipc.Message) *ipc.Message {
+			if m.MsgType == 7 {
+				return nil
+			}
+			return &ipc.Message{MsgType: m.MsgType, Data: bytes.ToUpper(m.Data)}
+		},
+	})
+
+	c.Write(7, []byte("dropped"))
+	c.Write(5, []byte("changed"))
+
+	ipctest.ExpectMessage(t, s, 5, []byte("CHANGED"))
+
+	if !strings.Contains(log.String(), `client->server type=7 len=7 dropped "dropped"`) {
+		t.Errorf("expected the dropped message to be logged, got %s", log.String())
+	}
+}
+
+func TestProxyDelay(t *testing.T) {
+
+	s, _, c := start(t, &Config{Delay: 100 * time.Millisecond, Jitter: 10 * time.Millisecond})
+
+	begin := time.Now()
+
+	c.Write(5, []byte("one"))
+	c.Write(5, []byte("two"))
+
+	ipctest.ExpectMessage(t, s, 5, []byte("one"))
+	ipctest.ExpectMessage(t, s, 5, []byte("two"))
+
+	if time.Since(begin) < 200*time.Millisecond {
+		t.Error("each message should have been delayed")
+	}
+}
+
+func TestProxyDropRate(t *testing.T) {
+
+	if _, err := Start("proxy", "upstream", &Config{DropRate: 1.5}); err == nil {
+		t.Error("a drop rate over 1 should be rejected")
+	}
+
+	var mutex sync.Mutex
+	dropped := 0
+
+	s, _, c := start(t, &Config{
+		DropRate: 1,
+		OnRecord: func(r Record) {
+			mutex.Lock()
+			if r.Dropped {
+				dropped++
+			}
+			mutex.Unlock()
+		},
+	})
+
+	c.Write(5, []byte("never arrives"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	s.Write(6, []byte("reply"))
+
+	// both directions drop everything, so neither side receives anything
+	if err := waitFor(ctx, func() bool { mutex.Lock(); defer mutex.Unlock(); return dropped == 2 }); err != nil {
+		t.Error("expected both messages to be dropped")
+	}
+}
+
+func waitFor(ctx context.Context, cond func() bool) error {
+
+	for !cond() {
+		select {
+		case <-time.After(5 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+package ipc
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ReconnectPolicy - decides how long the client waits between attempts to connect or reconnect, and when it gives up.
+// Set it with ClientConfig.ReconnectPolicy or WithReconnectPolicy() (default is ConstantBackoff with the RetryTimer).
+type ReconnectPolicy interface {
+	// NextDelay - called after a failed attempt, attempt is 1 after the first one and elapsed is the time since it started.
+	// Returns how long to wait before trying again, or false to give up.
+	NextDelay(attempt int, elapsed time.Duration) (time.Duration, bool)
+}
+
+// ConstantBackoff - waits the same time between every attempt and never gives up
+type ConstantBackoff struct {
+	Delay time.Duration
+}
+
+// NextDelay - returns Delay
+func (b ConstantBackoff) NextDelay(attempt int, elapsed time.Duration) (time.Duration, bool) {
+
+	return b.Delay, true
+}
+
+// ExponentialBackoff - multiplies the wait after each attempt up to a maximum, with some random jitter so
+// many clients that lost the same server don't all try to reconnect at once. It never gives up on its own,
+// see MaxAttempts() and MaxElapsed().
+type ExponentialBackoff struct {
+	Initial    time.Duration // wait after the first attempt (default is 100ms)
+	Max        time.Duration // longest wait (default is 30 seconds)
+	Multiplier float64       // how much the wait grows after each attempt (default is 2)
+	Jitter     float64       // fraction of the wait, 0 to 1, that is randomly taken off (default is 0, no jitter)
+}
+
+// NextDelay - returns Initial * Multiplier ^ (attempt - 1), no more than Max, less the jitter
+func (b ExponentialBackoff) NextDelay(attempt int, elapsed time.Duration) (time.Duration, bool) {
+
+	initial := b.Initial
+	if initial <= 0 {
+		initial = 100 * time.Millisecond
+	}
+
+	max := b.Max
+	if max <= 0 {
+		max = 30 * time.Second
+	}
+
+	multiplier := b.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+
+	d := float64(initial) * math.Pow(multiplier, float64(attempt-1))
+	if d > float64(max) {
+		d = float64(max)
+	}
+
+	if b.Jitter > 0 {
+		d -= d * math.Min(b.Jitter, 1) * rand.Float64()
+	}
+
+	return time.Duration(d), true
+}
+
+// MaxAttempts - gives up once there have been attempts failed attempts, otherwise waits as long as policy says
+func MaxAttempts(policy ReconnectPolicy, attempts int) ReconnectPolicy {
+
+	return maxAttempts{policy: policy, attempts: attempts}
+}
+
+type maxAttempts struct {
+	policy   ReconnectPolicy
+	attempts int
+}
+
+func (m maxAttempts) NextDelay(attempt int, elapsed time.Duration) (time.Duration, bool) {
+
+	if attempt >= m.attempts {
+		return 0, false
+	}
+
+	return m.policy.NextDelay(attempt, elapsed)
+}
+
+// MaxElapsed - gives up once the next attempt would start more than max after the first one, otherwise waits as long as policy says
+func MaxElapsed(policy ReconnectPolicy, max time.Duration) ReconnectPolicy {
+
+	return maxElapsed{policy: policy, max: max}
+}
+
+type maxElapsed struct {
+	policy ReconnectPolicy
+	max    time.Duration
+}
+
+func (m maxElapsed) NextDelay(attempt int, elapsed time.Duration) (time.Duration, bool) {
+
+	d, ok := m.policy.NextDelay(attempt, elapsed)
+	if !ok || elapsed+d > m.max {
+		return 0, false
+	}
+
+	return d, true
+}
+
+// retryWait - called by dial() after a failed attempt, reports the attempt in Events() then waits as long as the policy says.
+// Returns an error if the client should stop trying, because it timed out, the policy gave up or the client was closed.
+func (c *Client) retryWait(attempt int, start time.Time) error {
+
+	elapsed := c.clock.Now().Sub(start)
+
+	delay, ok := c.reconnectPolicy.NextDelay(attempt, elapsed)
+	if !ok {
+		return errors.New("gave up trying to connect")
+	}
+
+	if c.timeout != 0 && elapsed+delay > c.timeout {
+		return errors.New("timed out trying to connect")
+	}
+
+	c.mutex.Lock()
+	sendEvent(c.events, c.recorder, Event{Status: c.status, OldStatus: c.status, Attempt: attempt, NextDelay: delay})
+	c.mutex.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-c.clock.After(delay):
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// returns straight away if Close() is called while waiting
+	if c.WaitForStatus(ctx, Closing) == nil {
+		return errors.New("client has closed the connection")
+	}
+
+	return nil
+}
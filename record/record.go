@@ -0,0 +1,174 @@
+// Package record - captures the messages and status changes of an ipc server or client to a file, and replays them
+// into a real server or client with the original or accelerated timing, e.g. to turn a production session into a regression test.
+//
+// The file has one JSON Entry per line, so it can be read or edited by hand:
+//
+//	rec, err := record.Create("session.jsonl")
+//	c, err := ipc.NewClient("example", ipc.WithRecorder(rec))
+//	...
+//	rec.Close()
+package record
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	ipc "github.com/james-barrow/golang-ipc"
+)
+
+// Kind - what an Entry records
+type Kind string
+
+const (
+	Sent     Kind = "sent"     // a message written by the recorded server or client
+	Received Kind = "received" // a message read by the recorded server or client
+	Status   Kind = "status"   // the status changed
+	Error    Kind = "error"    // an error was reported on Events()
+)
+
+// Entry - a line of the recording
+type Entry struct {
+	Time    time.Time         `json:"time"`
+	Kind    Kind              `json:"kind"`
+	MsgType int               `json:"type,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Data    []byte            `json:"data,omitempty"` // base64 in the file
+	Status  string            `json:"status,omitempty"`
+	Err     string            `json:"error,omitempty"`
+}
+
+// Recorder - an ipc.Recorder that writes each entry to w as it happens, pass it to ipc.WithRecorder()
+type Recorder struct {
+	mutex  sync.Mutex
+	enc    *json.Encoder
+	closer io.Closer // the file opened by Create()
+	err    error     // the first error writing an entry
+	closed bool
+}
+
+// New - records to w, the caller closes w once the server or client has closed
+func New(w io.Writer) *Recorder {
+
+	return &Recorder{enc: json.NewEncoder(w)}
+}
+
+// Create - records to a new file, or truncates it if it exists. Close() closes the file
+func Create(name string) (*Recorder, error) {
+
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	r := New(f)
+	r.closer = f
+
+	return r, nil
+}
+
+// RecordSent - records a message written by the server or client
+func (r *Recorder) RecordSent(m *ipc.Message) {
+
+	r.write(Entry{Kind: Sent, MsgType: m.MsgType, Headers: m.Headers, Data: m.Data})
+}
+
+// RecordReceived - records a message read by the server or client
+func (r *Recorder) RecordReceived(m *ipc.Message) {
+
+	r.write(Entry{Kind: Received, MsgType: m.MsgType, Headers: m.Headers, Data: m.Data})
+}
+
+// RecordEvent - records a status change or error, attempts to connect aren't recorded
+func (r *Recorder) RecordEvent(e ipc.Event) {
+
+	switch {
+	case e.Err != nil:
+		r.write(Entry{Kind: Error, Status: e.Status.String(), Err: e.Err.Error()})
+	case e.Attempt == 0:
+		r.write(Entry{Kind: Status, Status: e.Status.String()})
+	}
+}
+
+// write - the entry is encoded straight away, so the message doesn't need to be copied
+func (r *Recorder) write(e Entry) {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.err != nil || r.closed {
+		return
+	}
+
+	e.Time = time.Now()
+	r.err = r.enc.Encode(e)
+}
+
+// Err - the first error writing an entry, nothing more is recorded after it
+func (r *Recorder) Err() error {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.err
+}
+
+// Close - stops recording, closes the file opened by Create() and returns the first error writing an entry
+func (r *Recorder) Close() error {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return errors.New("recorder is already closed")
+	}
+	r.closed = true
+
+	var err error
+	if r.closer != nil {
+		err = r.closer.Close()
+	}
+
+	if r.err != nil {
+		return r.err
+	}
+
+	return err
+}
+
+// Read - reads the entries of a recording
+func Read(rd io.Reader) ([]Entry, error) {
+
+	var entries []Entry
+
+	dec := json.NewDecoder(rd)
+
+	for {
+		var e Entry
+
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, e)
+	}
+}
+
+// Open - reads the entries of the recording in the file
+func Open(name string) ([]Entry, error) {
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Read(f)
+}
@@ -0,0 +1,243 @@
+package record
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ipc "github.com/james-barrow/golang-ipc"
+	"github.com/james-barrow/golang-ipc/ipctest"
+)
+
+func TestRecord(t *testing.T) {
+
+	file := filepath.Join(t.TempDir(), "session.jsonl")
+
+	rec, err := Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hook := &sentHook{Recorder: rec, sent: make(chan struct{}, 1)}
+
+	s, c := ipctest.NewPair(t, ipctest.ClientOptions(ipc.WithRecorder(hook)))
+
+	c.WriteMessage(&ipc.Message{MsgType: 5, Data: []byte("ping"), Headers: map[string]string{"k": "v"}})
+	ipctest.ExpectMessage(t, s, 5, []byte("ping"))
+
+	// the message is recorded once it has been flushed, which can be after the server has read it
+	select {
+	case <-hook.sent:
+	case <-time.After(ipctest.Timeout):
+		t.Fatal("the message sent should have been recorded")
+	}
+
+	s.Write(6, []byte{0, 1, 2})
+	ipctest.ExpectMessage(t, c, 6, []byte{0, 1, 2})
+
+	c.Close()
+
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var kinds []string
+	for _, e := range entries {
+		kinds = append(kinds, string(e.Kind)+":"+e.Status)
+	}
+
+	// the client may or may not have reached Closed by the time the recorder is closed
+	if got := strings.Join(kinds, " "); !strings.HasPrefix(got, "status:Connecting status:Connected sent: received: status:Closing") {
+		t.Fatalf("unexpected entries %s", got)
+	}
+
+	if e := entries[2]; e.MsgType != 5 || string(e.Data) != "ping" || e.Headers["k"] != "v" {
+		t.Errorf("unexpected sent entry %+v", e)
+	}
+
+	if e := entries[3]; e.MsgType != 6 || !bytes.Equal(e.Data, []byte{0, 1, 2}) {
+		t.Errorf("unexpected received entry %+v", e)
+	}
+
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Time.Before(entries[i-1].Time) {
+			t.Error("entries should be in time order")
+		}
+	}
+}
+
+// sentHook - signals each time a message sent is recorded
+type sentHook struct {
+	*Recorder
+	sent chan struct{}
+}
+
+func (h *sentHook) RecordSent(m *ipc.Message) {
+
+	h.Recorder.RecordSent(m)
+
+	select {
+	case h.sent <- struct{}{}:
+	default:
+	}
+}
+
+func TestRecorderClosed(t *testing.T) {
+
+	var buf bytes.Buffer
+	rec := New(&buf)
+
+	rec.RecordSent(&ipc.Message{MsgType: 1})
+	rec.Close()
+	rec.RecordSent(&ipc.Message{MsgType: 2})
+
+	entries, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 || entries[0].MsgType != 1 {
+		t.Errorf("nothing should be recorded once the recorder is closed, got %+v", entries)
+	}
+
+	if rec.Close() == nil {
+		t.Error("closing twice should be an error")
+	}
+
+	if _, err := Read(strings.NewReader("{not json")); err == nil {
+		t.Error("a broken recording should be an error")
+	}
+}
+
+func TestReplay(t *testing.T) {
+
+	start := time.Now()
+
+	entries := []Entry{
+		{Time: start, Kind: Status, Status: "Connected"},
+		{Time: start, Kind: Received, MsgType: 5, Data: []byte("one")},
+		{Time: start.Add(time.Second), Kind: Sent, MsgType: 9, Data: []byte("skipped")},
+		{Time: start.Add(4 * time.Second), Kind: Received, MsgType: 6, Data: []byte("two"), Headers: map[string]string{"k": "v"}},
+	}
+
+	s, c := ipctest.NewPair(t)
+	clock := ipctest.NewFakeClock()
+
+	replayed := make(chan error, 1)
+	go func() {
+		replayed <- Replay(context.Background(), s, entries, &ReplayConfig{Speed: 2, Clock: clock})
+	}()
+
+	ipctest.ExpectMessage(t, c, 5, []byte("one"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), ipctest.Timeout)
+	defer cancel()
+
+	if err := clock.BlockUntil(ctx, 1); err != nil {
+		t.Fatal("replay should be waiting for the second message")
+	}
+
+	// 4 seconds at twice the speed
+	clock.Advance(1999 * time.Millisecond)
+
+	select {
+	case <-replayed:
+		t.Fatal("replay shouldn't have finished before the clock reached the second message")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	clock.Advance(time.Millisecond)
+
+	m := ipctest.ExpectMessage(t, c, 6, []byte("two"))
+	if m.Headers["k"] != "v" {
+		t.Errorf("expected the headers to be replayed, got %v", m.Headers)
+	}
+
+	if err := <-replayed; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplayTTL(t *testing.T) {
+
+	file := filepath.Join(t.TempDir(), "session.jsonl")
+
+	rec, err := Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, c := ipctest.NewPair(t, ipctest.ClientOptions(ipc.WithRecorder(rec)))
+
+	s.Write(6, []byte("expires"), ipc.WithTTL(50*time.Millisecond))
+
+	m := ipctest.ExpectMessage(t, c, 6, []byte("expires"))
+	if m.Deadline.IsZero() || m.Headers[ipc.HeaderDeadline] != "" {
+		t.Errorf("the deadline should be in Deadline and not the headers, got %v %v", m.Deadline, m.Headers)
+	}
+
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// recordings made before the deadline was taken out of the headers still have it
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339Nano)
+	entries = append(entries, Entry{Time: time.Now(), Kind: Received, MsgType: 7, Data: []byte("old"), Headers: map[string]string{ipc.HeaderDeadline: past}})
+
+	time.Sleep(100 * time.Millisecond)
+
+	expired := make(chan *ipc.Message, 2)
+	s2, c2 := ipctest.NewPair(t, ipctest.ClientOptions(ipc.WithOnExpired(func(m *ipc.Message) { expired <- m })))
+
+	if err := Replay(context.Background(), s2, entries, &ReplayConfig{NoWait: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	ipctest.ExpectMessage(t, c2, 6, []byte("expires"))
+	ipctest.ExpectMessage(t, c2, 7, []byte("old"))
+
+	select {
+	case m := <-expired:
+		t.Errorf("a replayed message shouldn't expire with its original deadline, type %d", m.MsgType)
+	default:
+	}
+}
+
+func TestReplayNoWait(t *testing.T) {
+
+	start := time.Now()
+
+	entries := []Entry{
+		{Time: start, Kind: Sent, MsgType: 5, Data: []byte("one")},
+		{Time: start.Add(time.Hour), Kind: Sent, MsgType: 6, Data: []byte("two")},
+	}
+
+	s, c := ipctest.NewPair(t)
+
+	if err := Replay(context.Background(), c, entries, &ReplayConfig{Kind: Sent, NoWait: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	ipctest.ExpectMessage(t, s, 5, []byte("one"))
+	ipctest.ExpectMessage(t, s, 6, []byte("two"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := Replay(ctx, c, entries, &ReplayConfig{Kind: Sent}); err != context.Canceled {
+		t.Errorf("expected the replay to stop when ctx ends, got %v", err)
+	}
+}
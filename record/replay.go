@@ -0,0 +1,91 @@
+package record
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	ipc "github.com/james-barrow/golang-ipc"
+)
+
+// Writer - the server or client the recording is replayed through, ipc.Server or ipc.Client
+type Writer interface {
+	WriteMessage(m *ipc.Message) error
+}
+
+// ReplayConfig - used to pass configuation overrides to Replay()
+type ReplayConfig struct {
+	Kind   Kind      // which messages are written (default is Received, so the server or client under test gets what the recorded one did)
+	Speed  float64   // how much faster than recorded, 2 is twice as fast (default is 1, the original timing)
+	NoWait bool      // write the messages one after another without waiting (default is false)
+	Clock  ipc.Clock // used to wait between messages, e.g. the fake clock in the ipctest package (default is the system clock)
+}
+
+// Replay - writes the messages of the recording through w, in order, waiting the same time between them as when they were recorded.
+//
+// To replay what a recorded server received, connect a client to the server under test and pass it as w. To replay what a
+// recorded client received, start a server for the client under test to connect to and pass that.
+// Status changes and errors in the recording are skipped. Returns once every message has been queued, or when ctx ends.
+func Replay(ctx context.Context, w Writer, entries []Entry, config *ReplayConfig) error {
+
+	c := ReplayConfig{Kind: Received, Speed: 1}
+	if config != nil {
+		c = *config
+		if c.Kind == "" {
+			c.Kind = Received
+		}
+		if c.Speed <= 0 {
+			c.Speed = 1
+		}
+	}
+
+	var last time.Time
+
+	for i, e := range entries {
+
+		if e.Kind != c.Kind {
+			continue
+		}
+
+		if !last.IsZero() && !c.NoWait {
+			if err := wait(ctx, c.Clock, time.Duration(float64(e.Time.Sub(last))/c.Speed)); err != nil {
+				return err
+			}
+		}
+		last = e.Time
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := w.WriteMessage(&ipc.Message{MsgType: e.MsgType, Data: e.Data, Headers: e.Headers}); err != nil {
+			return fmt.Errorf("entry %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// wait - returns once d has passed on the clock, or ctx has ended
+func wait(ctx context.Context, clock ipc.Clock, d time.Duration) error {
+
+	if d <= 0 {
+		return nil
+	}
+
+	var after <-chan time.Time
+	if clock != nil {
+		after = clock.After(d)
+	} else {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		after = timer.C
+	}
+
+	select {
+	case <-after:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,13 @@
+package ipc
+
+// Recorder - hook that sees every message the server or client sends and receives, and every status change and error,
+// e.g. to capture a session so it can be replayed, see the record package. Pass it in ServerConfig.Recorder,
+// ClientConfig.Recorder or WithRecorder().
+//
+// The methods are called from the goroutines reading and writing the connection, so they should return quickly and mustn't
+// call methods on the server or client. The message is only valid during the call, copy the Data to keep it.
+type Recorder interface {
+	RecordSent(m *Message)     // a message has been written to the connection
+	RecordReceived(m *Message) // a message has been read from the connection, before Read() returns it
+	RecordEvent(e Event)       // the status has changed, or there's been an error, as sent to Events()
+}
@@ -0,0 +1,200 @@
+package ipc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ServerInfo - a running server announced in the registry, see WithService() and ListServers()
+type ServerInfo struct {
+	Name     string    `json:"name"`     // the name passed to StartServer(), which clients connect with
+	Protocol string    `json:"protocol"` // the application protocol the server speaks, e.g. "example.jobs"
+	Version  string    `json:"version"`  // the version of the protocol
+	PID      int       `json:"pid"`      // the process the server is running in
+	Addr     string    `json:"addr"`     // path of the unix socket or named pipe, empty if the server listens with a Transport
+	Started  time.Time `json:"started"`
+}
+
+// ListServers - the servers announced in the default registry directory, sorted by name.
+// Entries left behind by servers that are no longer running are removed.
+func ListServers() ([]ServerInfo, error) {
+
+	return ListServersIn(registryDir)
+}
+
+// ListServersIn - the same as ListServers() but for the registry in dir, see WithRegistryDir()
+func ListServersIn(dir string) ([]ServerInfo, error) {
+
+	files, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var servers []ServerInfo
+
+	for _, f := range files {
+
+		if !f.Type().IsRegular() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		file := filepath.Join(dir, f.Name())
+
+		data, err := readEntry(file)
+		if err != nil {
+			continue // removed since the directory was read, or it belongs to another user
+		}
+
+		var info ServerInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			continue
+		}
+
+		if !serverAlive(&info) {
+			os.Remove(file)
+			continue
+		}
+
+		servers = append(servers, info)
+	}
+
+	sort.Slice(servers, func(i, j int) bool { return servers[i].Name < servers[j].Name })
+
+	return servers, nil
+}
+
+// readEntry - the contents of a registry entry, an error if it belongs to another user
+func readEntry(file string) ([]byte, error) {
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.Mode().IsRegular() || !ownedByUser(info) {
+		return nil, errors.New("registry entry doesn't belong to this user")
+	}
+
+	return io.ReadAll(f)
+}
+
+// findServer - the name of the most recently started server in the registry that speaks protocol
+func findServer(dir, protocol string) (string, error) {
+
+	servers, err := ListServersIn(dir)
+	if err != nil {
+		return "", err
+	}
+
+	var found *ServerInfo
+
+	for i := range servers {
+		if servers[i].Protocol == protocol && (found == nil || servers[i].Started.After(found.Started)) {
+			found = &servers[i]
+		}
+	}
+
+	if found == nil {
+		return "", fmt.Errorf("no server is running for protocol %q", protocol)
+	}
+
+	return found.Name, nil
+}
+
+// register - announces the server in the registry once it's listening.
+// The entry is written to a temporary file first so ListServers() never reads half of one.
+func (s *Server) register(dir, protocol, version string) error {
+
+	if err := makeRegistryDir(dir); err != nil {
+		return err
+	}
+
+	info := ServerInfo{
+		Name:     s.name,
+		Protocol: protocol,
+		Version:  version,
+		PID:      os.Getpid(),
+		Started:  time.Now().UTC(),
+	}
+
+	// with socket activation the socket can be anywhere systemd was told to put it
+	if s.transport == nil {
+		info.Addr = s.listen.Addr().String()
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, s.name+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if err2 := tmp.Close(); err == nil {
+		err = err2
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(dir, s.name+".json"))
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	s.mutex.Lock()
+	s.registered = &info
+	s.registryDir = dir
+	s.mutex.Unlock()
+
+	return nil
+}
+
+// unregister - removes the server's entry from the registry, unless another server with the same name has replaced it
+func (s *Server) unregister() {
+
+	s.mutex.Lock()
+	info, dir := s.registered, s.registryDir
+	s.registered = nil
+	s.mutex.Unlock()
+
+	if info == nil {
+		return
+	}
+
+	file := filepath.Join(dir, s.name+".json")
+
+	data, err := readEntry(file)
+	if err != nil {
+		return
+	}
+
+	var current ServerInfo
+	if err := json.Unmarshal(data, &current); err != nil {
+		return
+	}
+
+	if current.PID == info.PID && current.Started.Equal(info.Started) {
+		os.Remove(file)
+	}
+}
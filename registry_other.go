@@ -0,0 +1,64 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package ipc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// registryDir - where servers announce themselves, next to the sockets.
+// Each user has their own, so nobody else can add entries that point clients at their server or remove entries
+var registryDir = fmt.Sprintf("/tmp/golang-ipc-%d", os.Getuid())
+
+// makeRegistryDir - creates dir if it doesn't exist, and makes sure it belongs to the user.
+// Anyone can create a directory in /tmp, so one created first by someone else isn't trusted
+func makeRegistryDir(dir string) error {
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() || !ownedByUser(info) {
+		return errors.New("registry directory " + dir + " doesn't belong to this user")
+	}
+
+	return nil
+}
+
+// ownedByUser - whether the file belongs to the user the process is running as
+func ownedByUser(info os.FileInfo) bool {
+
+	st, ok := info.Sys().(*syscall.Stat_t)
+
+	return ok && int(st.Uid) == os.Getuid()
+}
+
+// serverAlive - whether the process that announced the server is still running, and its socket hasn't been removed
+func serverAlive(info *ServerInfo) bool {
+
+	if info.PID <= 0 {
+		return false
+	}
+
+	// signal 0 only checks the process exists, EPERM means it belongs to another user
+	if err := syscall.Kill(info.PID, 0); err != nil && err != syscall.EPERM {
+		return false
+	}
+
+	if info.Addr != "" {
+		if _, err := os.Stat(info.Addr); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,48 @@
+package ipc
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// registryDir - where servers announce themselves, the temp directory is already per user
+var registryDir = filepath.Join(os.TempDir(), "golang-ipc")
+
+// makeRegistryDir - creates dir if it doesn't exist
+func makeRegistryDir(dir string) error {
+
+	return os.MkdirAll(dir, 0700)
+}
+
+// ownedByUser - always true, the temp directory is only open to the user
+func ownedByUser(info os.FileInfo) bool {
+
+	return true
+}
+
+const processQueryLimitedInformation = 0x1000
+
+const stillActive = 259 // exit code of a process that hasn't exited
+
+// serverAlive - whether the process that announced the server is still running
+func serverAlive(info *ServerInfo) bool {
+
+	if info.PID <= 0 {
+		return false
+	}
+
+	h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(info.PID))
+	if err != nil {
+		// the process belongs to another user
+		return err == syscall.ERROR_ACCESS_DENIED
+	}
+	defer syscall.CloseHandle(h)
+
+	var code uint32
+	if err := syscall.GetExitCodeProcess(h, &code); err != nil {
+		return true
+	}
+
+	return code == stillActive
+}
@@ -1,88 +1,182 @@
 package ipc
 
 import (
-	"bufio"
+	"context"
 	"errors"
-	"io"
-	"log"
+	"os"
 	"time"
+
+	"github.com/james-barrow/golang-ipc/wire"
 )
 
 // StartServer - starts the ipc server.
 //
 // ipcName - is the name of the unix socket or named pipe that will be created, the client needs to use the same name
+// config - can be nil for the defaults, NewServer() is the same but takes options instead.
 func StartServer(ipcName string, config *ServerConfig) (*Server, error) {
 
+	o := config.options()
+
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+
+	return newServer(ipcName, o)
+}
+
+// NewServer - starts the ipc server configured with opts, e.g. NewServer("name", WithMaxMsgSize(1 << 20), WithSuppressStatus()).
+// An error is returned if an option is invalid or doesn't apply to a server.
+func NewServer(ipcName string, opts ...Option) (*Server, error) {
+
+	o := defaultOptions()
+
+	if err := o.apply(opts, true); err != nil {
+		return nil, err
+	}
+
+	return newServer(ipcName, o)
+}
+
+func newServer(ipcName string, o *options) (*Server, error) {
+
 	err := checkIpcName(ipcName)
 	if err != nil {
 		return nil, err
 	}
 
 	s := &Server{
-		name:     ipcName,
-		status:   NotConnected,
-		received: make(chan *Message),
-		toWrite:  make(chan *Message),
+		name:         ipcName,
+		status:       NotConnected,
+		received:     make(chan *Message),
+		toWrite:      make(chan *Message, o.writeBuffer),
+		toWriteHigh:  make(chan *Message, o.writeBuffer),
+		toWriteLow:   make(chan *Message, o.writeBuffer),
+		events:       make(chan Event, eventBuffer),
+		closing:      make(chan struct{}),
+		closed:       make(chan struct{}),
+		stats:        newStats(),
+		maxMsgSize:   o.maxMsgSize,
+		encryption:   o.encryption,
+		unMask:       o.unmask,
+		noStatus:     o.noStatus,
+		tracer:       o.tracer,
+		writePolicy:  o.writePolicy,
+		maxBatch:     o.maxBatch,
+		batchLatency: o.batchLatency,
+		shmSize:      o.shmSize,
+		onExpired:    o.onExpired,
+		transport:    o.transport,
+		recorder:     o.recorder,
+		activated:    o.activation,
 	}
 
-	if config == nil {
-		s.timeout = 0
-		s.maxMsgSize = maxMsgSize
-		s.encryption = true
-		s.unMask = false
-
-	} else {
+	s.metrics = newMetrics(s.stats, o.metrics)
 
-		if config.MaxMsgSize < 1024 {
-			s.maxMsgSize = maxMsgSize
-		} else {
-			s.maxMsgSize = config.MaxMsgSize
-		}
+	if s.tracer == nil {
+		s.tracer = contextTracer{}
+	}
 
-		if !config.Encryption {
-			s.encryption = false
-		} else {
-			s.encryption = true
-		}
+	if s.transport != nil {
+		err = s.listenTransport()
+	} else {
+		err = s.run()
+	}
 
-		if config.UnmaskPermissions {
-			s.unMask = true
-		} else {
-			s.unMask = false
+	if err == nil && o.service != "" {
+		if err = s.register(o.registryDir, o.service, o.version); err != nil {
+			s.Close()
 		}
 	}
 
-	err = s.run()
-
 	return s, err
 }
 
 func (s *Server) acceptLoop() {
 
+	defer s.wg.Done()
+
 	for {
 		conn, err := s.listen.Accept()
 		if err != nil {
 			break
 		}
 
-		if s.status == Listening || s.status == Disconnected {
+		status := s.getStatus()
 
+		if status == Listening || status == Disconnected {
+
+			s.mutex.Lock()
 			s.conn = conn
+			s.mutex.Unlock()
+
+			start := time.Now()
+
+			// a client that stops part way through the handshake would otherwise hold up the clients waiting behind it
+			raw := conn
+			raw.SetDeadline(start.Add(handshakeTimeout))
 
 			err2 := s.handshake()
 			if err2 != nil {
-				s.received <- &Message{Err: err2, MsgType: -1}
-				s.status = Error
-				s.listen.Close()
-				s.conn.Close()
+				s.dropConn(raw, err2)
 
 			} else {
 
-				go s.read()
-				go s.write()
+				s.metrics.Handshake(time.Since(start))
+
+				// the handshake may have swapped the socket for the shared memory transport
+				s.mutex.Lock()
+				conn = s.conn
+				s.mutex.Unlock()
+
+				if s.peerCaps&capFiles != 0 {
+					conn = newFileConn(conn, s.encryption)
+				}
+
+				sess := &session{conn: conn, peerCaps: uint32(s.peerCaps), done: make(chan struct{})}
+				if s.encryption {
+					sess.cipher = *s.enc.cipher
+				}
+
+				peer := newPeer(conn, s.encryption, s.maxMsgSize)
+
+				if s.peerCaps&capClientID != 0 {
+					id, err := s.readHello(sess)
+					if err != nil {
+						s.dropConn(conn, err)
+						continue
+					}
 
-				s.status = Connected
-				s.received <- &Message{Status: s.status.String(), MsgType: -1}
+					peer.ClientID = id
+					peer.Returning = id == s.lastClientID
+					s.lastClientID = id
+				}
+
+				raw.SetDeadline(time.Time{})
+
+				if s.peerCaps&capHeaders != 0 {
+					// newer clients are told what the server can do before anything else is sent,
+					// if the client has already gone the read goroutine finds out
+					if b, err := frame(sess.cipher, 0, []byte{ctrlCaps, serverCaps}); err == nil {
+						conn.Write(b)
+					}
+				}
+
+				s.setPeer(peer)
+
+				if !s.setStatus(Connected) {
+					// closed during the handshake
+					conn.Close()
+					continue
+				}
+
+				s.wg.Add(2)
+				go s.read(sess)
+				go s.write(sess)
+
+				s.notify(Connected)
+
+				// only one client at a time, any others wait to be accepted until this one has gone
+				<-sess.done
 			}
 
 		}
@@ -91,85 +185,161 @@ func (s *Server) acceptLoop() {
 
 }
 
-func (s *Server) read() {
+// read - reads messages until the connection ends, then closes sess.done to stop the write goroutine
+func (s *Server) read(sess *session) {
 
-	bLen := make([]byte, 4)
+	defer s.wg.Done()
+	defer close(sess.done)
 
-	for {
+	var headers map[string]string
+	var files []*os.File
+	var buf *[]byte
 
-		res := s.readData(bLen)
-		if !res {
-			s.conn.Close()
+	maxMsgSize := s.maxMsgSize
 
-			break
-		}
+	dec := wire.NewDecoder(sess.conn, sess.cipher, maxMsgSize)
+	dec.Alloc = func(n int) []byte {
+		buf = getBuffer(n)
+		return *buf
+	}
+
+	for {
 
-		mLen := bytesToInt(bLen)
+		buf = nil
 
-		msgRecvd := make([]byte, mLen)
+		f, err := dec.Decode()
+		if err != nil {
+			putBuffer(buf)
 
-		res = s.readData(msgRecvd)
-		if !res {
-			s.conn.Close()
+			var decryptErr *wire.DecryptError
 
+			switch {
+			case errors.As(err, &decryptErr):
+				s.metrics.DecryptionError()
+				s.reportError(err, -1)
+				continue
+			case err == wire.ErrFrameTooLong || err == wire.ErrFrameTooShort:
+				// the rest of the stream can't be trusted, the next read fails and ends the connection
+				s.reportError(err, -1)
+				sess.conn.Close()
+				continue
+			}
+
+			s.readFailed()
+			sess.conn.Close()
 			break
 		}
 
-		if s.encryption {
-			msgFinal, err := decrypt(*s.enc.cipher, msgRecvd)
-			if err != nil {
-				s.received <- &Message{Err: err, MsgType: -1}
-				continue
+		msgType, data := f.MsgType, f.Data
+
+		if msgType == 0 {
+			//  type 0 = control message
+			code, h := control(data)
+
+			switch code {
+			case ctrlHeaders:
+				headers = h
+			case ctrlFiles:
+				files = sess.takeFiles(data[1:])
+			case ctrlChunk:
+				t, msg, err := sess.addChunk(data[1:], maxMsgSize)
+				if err != nil {
+					s.reportError(err, -1)
+				}
+				if msg != nil {
+					// the last chunk, the message is delivered below
+					putBuffer(buf)
+					buf = nil
+					msgType, data = t, msg
+				}
 			}
 
-			if bytesToInt(msgFinal[:4]) == 0 {
-				//  type 0 = control message
-			} else {
-				s.received <- &Message{Data: msgFinal[4:], MsgType: bytesToInt(msgFinal[:4])}
+			if msgType == 0 {
+				putBuffer(buf)
+
+				if code == ctrlGoodbye {
+					// the client has shut down, it won't reconnect
+					sess.conn.Close()
+					s.setPeer(nil)
+					s.statusChange(Disconnected)
+					break
+				}
+
+				continue
 			}
+		}
 
-		} else {
-			if bytesToInt(msgRecvd[:4]) == 0 {
-				//  type 0 = control message
-			} else {
-				s.received <- &Message{Data: msgRecvd[4:], MsgType: bytesToInt(msgRecvd[:4])}
+		s.metrics.MessageReceived(msgType, len(data))
+		m := newMessage(s.tracer, msgType, data, headers)
+		m.buf = buf
+		m.Files = files
+		headers = nil
+		files = nil
+
+		if m.expired(time.Now()) {
+			s.metrics.MessageExpired(msgType)
+			if s.onExpired != nil {
+				s.onExpired(m)
 			}
+			closeFiles(m.Files)
+			m.Release()
+			continue
+		}
+
+		if s.recorder != nil {
+			s.recorder.RecordReceived(m)
+		}
+
+		if !s.deliver(m) {
+			closeFiles(m.Files)
+			m.Release()
 		}
 
 	}
 
 }
 
-func (s *Server) readData(buff []byte) bool {
-
-	_, err := io.ReadFull(s.conn, buff)
-	if err != nil {
+// readFailed - the connection couldn't be read from, either the server is closing or the client has gone
+func (s *Server) readFailed() {
 
-		if s.status == Closing {
+	if s.getStatus() == Closing {
+		s.closeRead(errors.New("server has closed the connection"))
+		return
+	}
 
-			s.status = Closed
-			s.received <- &Message{Status: s.status.String(), MsgType: -1}
-			s.received <- &Message{Err: errors.New("server has closed the connection"), MsgType: -1}
-			return false
-		}
+	// EOF, or any other error such as the connection being reset, means the client has gone
+	s.setPeer(nil)
+	s.statusChange(Disconnected)
+}
 
-		if err == io.EOF {
+// readClosed - what Read() returns once the connection has been closed, see closeRead()
+func (s *Server) readClosed() (*Message, error) {
 
-			s.status = Disconnected
-			s.received <- &Message{Status: s.status.String(), MsgType: -1}
-			return false
-		}
+	s.mutex.Lock()
+	notify := s.closeStatus
+	s.closeStatus = false
+	s.mutex.Unlock()
 
+	if notify {
+		return &Message{Status: "Closed", MsgType: -1}, nil
 	}
 
-	return true
+	return nil, s.closeErr
 }
 
 // Read - blocking function, reads each message recieved
-// if MsgType is a negative number its an internal message
+// if MsgType is a negative number its an internal message, these can be turned off with ServerConfig.SuppressStatus
 func (s *Server) Read() (*Message, error) {
 
-	m, ok := (<-s.received)
+	var m *Message
+	var ok bool
+
+	select {
+	case m, ok = <-s.received:
+	case <-s.closed:
+		return s.readClosed()
+	}
+
 	if !ok {
 		return nil, errors.New("the received channel has been closed")
 	}
@@ -185,101 +355,192 @@ func (s *Server) Read() (*Message, error) {
 
 // Write - writes a message to the ipc connection
 // msgType - denotes the type of data being sent. 0 is a reserved type for internal messages and errors.
-func (s *Server) Write(msgType int, message []byte) error {
+// opts - e.g. WithTTL(), a message that hasn't been written before its deadline is dropped.
+func (s *Server) Write(msgType int, message []byte, opts ...WriteOption) error {
 
-	if msgType == 0 {
-		return errors.New("message type 0 is reserved")
-	}
+	return s.queue(newWrite(time.Now(), msgType, message, opts), s.writePolicy)
+}
+
+// TryWrite - the same as Write() but never blocks, ErrQueueFull is returned if the outbound buffer is full
+func (s *Server) TryWrite(msgType int, message []byte, opts ...WriteOption) error {
+
+	return s.queue(newWrite(time.Now(), msgType, message, opts), WriteFailFast)
+}
+
+// WritePriority - writes a message with the given priority, queued messages with a higher priority are written first
+func (s *Server) WritePriority(priority Priority, msgType int, message []byte) error {
+
+	return s.queue(&Message{MsgType: msgType, Data: message, Priority: priority}, s.writePolicy)
+}
 
-	mlen := len(message)
+// WriteContext - writes a message to the ipc connection along with the trace context held in ctx.
+// The trace context is taken from ctx by ServerConfig.Tracer, or ContextWithTrace() if no tracer is set.
+func (s *Server) WriteContext(ctx context.Context, msgType int, message []byte) error {
 
-	if mlen > s.maxMsgSize {
-		return errors.New("message exceeds maximum message length")
+	headers, err := traceHeaders(s.tracer, ctx, nil)
+	if err != nil {
+		return err
 	}
 
-	if s.status == Connected {
+	return s.queue(&Message{MsgType: msgType, Data: message, Headers: headers}, s.writePolicy)
+}
 
-		s.toWrite <- &Message{MsgType: msgType, Data: message}
+// WriteMessage - writes m.MsgType, m.Data and m.Headers to the ipc connection.
+// The headers are dropped if the other end of the connection doesn't support them.
+func (s *Server) WriteMessage(m *Message) error {
 
-	} else {
-		return errors.New(s.status.String())
+	if err := wire.ValidHeaders(m.Headers); err != nil {
+		return err
 	}
 
-	return nil
+	return s.queue(&Message{MsgType: m.MsgType, Data: m.Data, Headers: m.Headers, Priority: m.Priority, Deadline: m.Deadline}, s.writePolicy)
 }
 
-func (s *Server) write() {
+// WriteBatch - writes the messages in order, they are written together without any other message in between.
+// Either all of the messages are queued or, if any of them can't be sent, none are. The batch has the priority of the first message.
+func (s *Server) WriteBatch(messages []Message) error {
 
-	for {
+	if len(messages) == 0 {
+		return nil
+	}
 
-		m, ok := <-s.toWrite
+	batch := make([]*Message, len(messages))
 
-		if !ok {
-			break
+	for i, m := range messages {
+		if err := wire.ValidHeaders(m.Headers); err != nil {
+			return err
 		}
 
-		toSend := intToBytes(m.MsgType)
-
-		writer := bufio.NewWriter(s.conn)
+		batch[i] = &Message{MsgType: m.MsgType, Data: m.Data, Headers: m.Headers, Deadline: m.Deadline}
+	}
 
-		if s.encryption {
-			toSend = append(toSend, m.Data...)
-			toSendEnc, err := encrypt(*s.enc.cipher, toSend)
-			if err != nil {
-				log.Println("error encrypting data", err)
-				continue
-			}
+	return s.queue(&Message{batch: batch, Priority: messages[0].Priority}, s.writePolicy)
+}
 
-			toSend = toSendEnc
-		} else {
+// queue - checks the message can be sent and passes it to the write goroutine
+func (s *Server) queue(m *Message, policy WritePolicy) error {
 
-			toSend = append(toSend, m.Data...)
+	for _, mm := range m.messages() {
 
+		if mm.MsgType == 0 {
+			return errors.New("message type 0 is reserved")
 		}
 
-		writer.Write(intToBytes(len(toSend)))
-		writer.Write(toSend)
+		mlen := len(mm.Data)
 
-		err := writer.Flush()
-		if err != nil {
-			log.Println("error flushing data", err)
-			continue
+		if mlen > s.maxMsgSize {
+			return errors.New("message exceeds maximum message length")
 		}
+	}
 
-		time.Sleep(2 * time.Millisecond)
-
+	if status := s.getStatus(); status != Connected {
+		return errors.New(status.String())
 	}
+
+	return enqueue(s.queueFor(m.Priority), m, policy, s.metrics)
 }
 
+// queueFor - the outbound queue for messages of the priority
+func (s *Server) queueFor(p Priority) chan *Message {
 
-// getStatus - get the current status of the connection
-func (s *Server) getStatus() Status {
+	switch p.lane() {
+	case 0:
+		return s.toWriteHigh
+	case 2:
+		return s.toWriteLow
+	}
 
-	return s.status
+	return s.toWrite
 }
 
+// write - writes queued messages until the session ends or a goodbye has been sent
+func (s *Server) write(sess *session) {
+
+	defer s.wg.Done()
+
+	writeLoop(sess, newLanes(s.toWriteHigh, s.toWrite, s.toWriteLow, s.metrics, realClock{}), s.maxBatch, s.batchLatency, s.metrics, s.recorder)
+}
 
 // StatusCode - returns the current connection status
 func (s *Server) StatusCode() Status {
-	return s.status
+	return s.getStatus()
 }
 
 // Status - returns the current connection status as a string
 func (s *Server) Status() string {
 
-	return s.status.String()
+	status := s.getStatus()
+
+	return status.String()
 }
 
 // Close - closes the connection
 func (s *Server) Close() {
 
-	s.status = Closing
+	s.setStatus(Closing)
+
+	s.unregister()
 
 	if s.listen != nil {
 		s.listen.Close()
 	}
 
-	if s.conn != nil {
-		s.conn.Close()
+	s.mutex.Lock()
+	conn := s.conn
+	s.mutex.Unlock()
+
+	if conn != nil {
+		conn.Close()
 	}
+
+	// there's no read goroutine to do this while the server is waiting for a client
+	s.closeRead(errors.New("server has closed the connection"))
+}
+
+// Shutdown - gracefully closes the server.
+// Write() is stopped, messages already queued are sent followed by a goodbye so the client knows not to reconnect,
+// then the connection is closed and the socket removed. Read() returns an error once the connection has closed. Shutdown waits for the server's goroutines to exit,
+// if ctx ends first the connection is closed straight away and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+
+	connected := s.getStatus() == Connected
+
+	s.setStatus(Closing)
+
+	s.unregister()
+
+	if s.listen != nil {
+		s.listen.Close()
+	}
+
+	finished := make(chan struct{})
+
+	go func() {
+
+		s.wg.Wait()
+		close(finished)
+	}()
+
+	if connected {
+		select {
+		case s.toWriteLow <- goodbye(): // the lowest priority, so it's written after everything else
+		case <-finished: // the connection was lost first, there's no write goroutine to send it
+		case <-ctx.Done():
+		}
+	}
+
+	if s.transport == nil {
+		s.removeSocket()
+	}
+
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		s.Close()
+		return ctx.Err()
+	}
+
+	s.closeRead(errors.New("server has closed the connection")) // if it hasn't already been closed by the read goroutine
+
+	return nil
 }
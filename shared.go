@@ -40,3 +40,41 @@ func checkIpcName(ipcName string) error {
 
 	return nil
 }
+
+// enqueue - adds the message to the outbound queue, following the write policy when the queue is full
+func enqueue(toWrite chan *Message, m *Message, policy WritePolicy, metrics Metrics) error {
+
+	switch policy {
+	case WriteFailFast:
+		select {
+		case toWrite <- m:
+			return nil
+		default:
+			return ErrQueueFull
+		}
+
+	case WriteDropOldest:
+		if cap(toWrite) == 0 {
+			break // nothing is ever queued to drop
+		}
+
+		for {
+			select {
+			case toWrite <- m:
+				return nil
+			default:
+			}
+
+			select {
+			case old := <-toWrite:
+				metrics.MessageDropped(old.MsgType)
+				closeFiles(old.Files)
+			default:
+			}
+		}
+	}
+
+	toWrite <- m
+
+	return nil
+}
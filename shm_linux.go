@@ -0,0 +1,409 @@
+//go:build linux
+// +build linux
+
+package ipc
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Shared memory transport - once the handshake is done the server creates a memfd holding two ring buffers,
+// one for each direction, and passes it to the client over the socket with SCM_RIGHTS.
+// From then on frames are written into the rings and the socket only carries single byte signals,
+// sent when the other end is waiting for data or for space.
+//
+// Each ring is a 64 byte header, [8 byte head][8 byte tail][4 byte reader waiting][4 byte writer waiting],
+// followed by the data. head and tail only ever increase, the position in the data is head or tail % size.
+
+const (
+	sigData  = 1 // there is data in the ring for the reader
+	sigSpace = 2 // there is space in the ring for the writer
+)
+
+const ringHeader = 64
+
+// shmSeals - stop either end changing the size of the memory once the other has mapped it, touching a page that has gone is a SIGBUS
+const shmSeals = unix.F_SEAL_SHRINK | unix.F_SEAL_GROW | unix.F_SEAL_SEAL
+
+type ring struct {
+	head          *uint64
+	tail          *uint64
+	readerWaiting *uint32
+	writerWaiting *uint32
+	data          []byte
+}
+
+func newRing(mem []byte) ring {
+
+	return ring{
+		head:          (*uint64)(unsafe.Pointer(&mem[0])),
+		tail:          (*uint64)(unsafe.Pointer(&mem[8])),
+		readerWaiting: (*uint32)(unsafe.Pointer(&mem[16])),
+		writerWaiting: (*uint32)(unsafe.Pointer(&mem[20])),
+		data:          mem[ringHeader:],
+	}
+}
+
+// shmConn - a net.Conn that reads and writes through the rings, everything else goes to the socket
+type shmConn struct {
+	net.Conn
+
+	mu  sync.RWMutex // guards mem, it is unmapped by Close()
+	mem []byte
+	in  ring
+	out ring
+
+	data  chan struct{}
+	space chan struct{}
+	done  chan struct{}
+	err   error // why the socket ended, only read after done is closed
+}
+
+// ringSize - rounds the size of each ring up so the rings, and their headers, stay 64 byte aligned
+func ringSize(size int) int {
+
+	return (size + ringHeader - 1) / ringHeader * ringHeader
+}
+
+func newShmConn(conn net.Conn, mem []byte, server bool) *shmConn {
+
+	size := len(mem) / 2
+	first, second := newRing(mem[:size]), newRing(mem[size:])
+
+	c := &shmConn{
+		Conn:  conn,
+		mem:   mem,
+		data:  make(chan struct{}, 1),
+		space: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+
+	// the first ring carries frames from the server to the client
+	if server {
+		c.out, c.in = first, second
+	} else {
+		c.in, c.out = first, second
+	}
+
+	go c.signals()
+
+	return c
+}
+
+// signals - reads the signals sent over the socket until it closes
+func (c *shmConn) signals() {
+
+	buff := make([]byte, 64)
+
+	for {
+		n, err := c.Conn.Read(buff)
+
+		for _, sig := range buff[:n] {
+			switch sig {
+			case sigData:
+				wake(c.data)
+			case sigSpace:
+				wake(c.space)
+			}
+		}
+
+		if err != nil {
+			c.err = err
+			close(c.done)
+			return
+		}
+	}
+}
+
+func wake(ch chan struct{}) {
+
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (c *shmConn) Read(b []byte) (int, error) {
+
+	for {
+
+		n, err := c.readRing(b)
+		if n > 0 || err != nil {
+			return n, err
+		}
+
+		select {
+		case <-c.data:
+		case <-c.done:
+			// anything written before the socket closed is still in the ring, e.g. a goodbye
+			n, err := c.readRing(b)
+			if n > 0 || err != nil {
+				return n, err
+			}
+			return 0, c.err
+		}
+	}
+}
+
+// readRing - copies whatever is in the ring into b, if it is empty the writer is asked to signal when there is more
+func (c *shmConn) readRing(b []byte) (int, error) {
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.mem == nil {
+		return 0, io.ErrClosedPipe
+	}
+
+	r := c.in
+	size := uint64(len(r.data))
+
+	tail := atomic.LoadUint64(r.tail)
+	avail := atomic.LoadUint64(r.head) - tail
+
+	if avail == 0 {
+		atomic.StoreUint32(r.readerWaiting, 1)
+
+		// the writer may have added data before it could see the flag
+		avail = atomic.LoadUint64(r.head) - tail
+		if avail == 0 {
+			return 0, nil
+		}
+	}
+
+	if avail > size {
+		return 0, errors.New("shared memory ring is corrupt")
+	}
+
+	if avail > uint64(len(b)) {
+		avail = uint64(len(b))
+	}
+
+	pos := tail % size
+	n := copy(b[:avail], r.data[pos:])
+	copy(b[n:avail], r.data)
+
+	atomic.StoreUint64(r.tail, tail+avail)
+
+	if atomic.CompareAndSwapUint32(r.writerWaiting, 1, 0) {
+		c.signal(sigSpace)
+	}
+
+	return int(avail), nil
+}
+
+func (c *shmConn) Write(b []byte) (int, error) {
+
+	written := 0
+
+	for len(b) > 0 {
+
+		n, err := c.writeRing(b)
+		if err != nil {
+			return written, err
+		}
+
+		written += n
+		b = b[n:]
+
+		if n == 0 {
+			select {
+			case <-c.space:
+			case <-c.done:
+				return written, io.ErrClosedPipe
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// writeRing - copies as much of b as fits into the ring, if it is full the reader is asked to signal when there is space
+func (c *shmConn) writeRing(b []byte) (int, error) {
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.mem == nil {
+		return 0, io.ErrClosedPipe
+	}
+
+	r := c.out
+	size := uint64(len(r.data))
+
+	head := atomic.LoadUint64(r.head)
+	used := head - atomic.LoadUint64(r.tail)
+
+	if used == size {
+		atomic.StoreUint32(r.writerWaiting, 1)
+
+		// the reader may have made space before it could see the flag
+		used = head - atomic.LoadUint64(r.tail)
+		if used == size {
+			return 0, nil
+		}
+	}
+
+	if used > size {
+		return 0, errors.New("shared memory ring is corrupt")
+	}
+
+	free := size - used
+	if free > uint64(len(b)) {
+		free = uint64(len(b))
+	}
+
+	pos := head % size
+	n := copy(r.data[pos:], b[:free])
+	copy(r.data, b[n:free])
+
+	atomic.StoreUint64(r.head, head+free)
+
+	if atomic.CompareAndSwapUint32(r.readerWaiting, 1, 0) {
+		c.signal(sigData)
+	}
+
+	return int(free), nil
+}
+
+func (c *shmConn) signal(sig byte) {
+
+	c.Conn.Write([]byte{sig})
+}
+
+// Close - closes the socket and unmaps the rings
+func (c *shmConn) Close() error {
+
+	err := c.Conn.Close()
+
+	c.mu.Lock()
+	if c.mem != nil {
+		unix.Munmap(c.mem)
+		c.mem = nil
+	}
+	c.mu.Unlock()
+
+	return err
+}
+
+// sharedMemory - answers a client that asked for shared memory, 0 = carry on using the socket, 1 = the memfd is attached
+func (sc *Server) sharedMemory() error {
+
+	uc, ok := sc.conn.(*net.UnixConn)
+	if sc.shmSize == 0 || !ok {
+		_, err := sc.conn.Write([]byte{0})
+		return err
+	}
+
+	size := 2 * (ringHeader + ringSize(sc.shmSize))
+
+	fd, err := unix.MemfdCreate("ipc-"+sc.name, unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	if err != nil {
+		return err
+	}
+
+	f := os.NewFile(uintptr(fd), "ipc-"+sc.name)
+	defer f.Close()
+
+	err = f.Truncate(int64(size))
+	if err != nil {
+		return err
+	}
+
+	// the client gets a writable fd, once sealed it can't shrink the memory and crash the server with SIGBUS
+	_, err = unix.FcntlInt(uintptr(fd), unix.F_ADD_SEALS, shmSeals)
+	if err != nil {
+		return err
+	}
+
+	mem, err := unix.Mmap(fd, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = uc.WriteMsgUnix([]byte{1}, unix.UnixRights(fd), nil)
+	if err != nil {
+		unix.Munmap(mem)
+		return errors.New("unable to send shared memory")
+	}
+
+	sc.mutex.Lock()
+	sc.conn = newShmConn(uc, mem, true)
+	sc.mutex.Unlock()
+
+	return nil
+}
+
+// sharedMemory - receives the memfd from the server, unless it has chosen to carry on using the socket
+func (cc *Client) sharedMemory() error {
+
+	uc, ok := cc.conn.(*net.UnixConn)
+	if !ok {
+		return errors.New("shared memory needs a unix socket")
+	}
+
+	buff := make([]byte, 1)
+	oob := make([]byte, unix.CmsgSpace(4))
+
+	_, oobn, _, _, err := uc.ReadMsgUnix(buff, oob)
+	if err != nil {
+		return errors.New("failed to receive shared memory reply")
+	}
+
+	if buff[0] == 0 {
+		return nil
+	}
+
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		return errors.New("server did not send the shared memory")
+	}
+
+	fds, err := unix.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) != 1 {
+		return errors.New("server did not send the shared memory")
+	}
+
+	f := os.NewFile(uintptr(fds[0]), "ipc-"+cc.Name)
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// the same goes for the server, unless the size is sealed it could shrink the memory after it has been mapped
+	seals, err := unix.FcntlInt(uintptr(fds[0]), unix.F_GET_SEALS, 0)
+	if err != nil || seals&shmSeals != shmSeals {
+		return errors.New("shared memory isn't sealed")
+	}
+
+	size := int(info.Size())
+	if size < 2*(ringHeader+ringHeader) || size%(2*ringHeader) != 0 {
+		return errors.New("shared memory is the wrong size")
+	}
+
+	mem, err := unix.Mmap(fds[0], 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+
+	cc.mutex.Lock()
+	cc.conn = newShmConn(uc, mem, false)
+	cc.mutex.Unlock()
+
+	return nil
+}
+
+func sharedMemorySupported() bool {
+
+	return true
+}
@@ -0,0 +1,95 @@
+package ipc
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func shmPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(t.TempDir(), "shm.sock"), Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client, err := net.DialUnix("unix", nil, l.Addr().(*net.UnixAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := l.AcceptUnix()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return server, client
+}
+
+func TestSharedMemorySealed(t *testing.T) {
+
+	server, client := shmPair(t)
+	defer client.Close()
+
+	sc := &Server{name: "test_shm_sealed", conn: server, shmSize: 4096}
+	if err := sc.sharedMemory(); err != nil {
+		t.Fatal(err)
+	}
+	defer sc.conn.Close()
+
+	buff := make([]byte, 1)
+	oob := make([]byte, unix.CmsgSpace(4))
+
+	_, oobn, _, _, err := client.ReadMsgUnix(buff, oob)
+	if err != nil || buff[0] != 1 {
+		t.Fatal("expected the shared memory", err)
+	}
+
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		t.Fatal(err)
+	}
+
+	fds, err := unix.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) != 1 {
+		t.Fatal(err)
+	}
+	defer unix.Close(fds[0])
+
+	// a client that shrinks the memory would crash the server the next time it touches it
+	if err := unix.Ftruncate(fds[0], 0); err == nil {
+		t.Error("the client shouldn't be able to shrink the shared memory")
+	}
+}
+
+func TestSharedMemoryUnsealed(t *testing.T) {
+
+	server, client := shmPair(t)
+	defer server.Close()
+	defer client.Close()
+
+	fd, err := unix.MemfdCreate("test_shm_unsealed", unix.MFD_CLOEXEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := os.NewFile(uintptr(fd), "test_shm_unsealed")
+	defer f.Close()
+
+	if err := f.Truncate(2 * (ringHeader + 4096)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := server.WriteMsgUnix([]byte{1}, unix.UnixRights(fd), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	cc := &Client{Name: "test_shm_unsealed", conn: client}
+	if err := cc.sharedMemory(); err == nil || err.Error() != "shared memory isn't sealed" {
+		t.Error("a client shouldn't map memory the server could shrink", err)
+	}
+}
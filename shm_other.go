@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package ipc
+
+// sharedMemory - the shared memory transport is only available on linux, the client is told to carry on using the connection
+func (sc *Server) sharedMemory() error {
+
+	_, err := sc.conn.Write([]byte{0})
+	return err
+}
+
+// sharedMemory - never called, StartClient() refuses SharedMemory on other platforms
+func (cc *Client) sharedMemory() error {
+
+	return nil
+}
+
+func sharedMemorySupported() bool {
+
+	return false
+}
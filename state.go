@@ -0,0 +1,189 @@
+package ipc
+
+import "context"
+
+// transitions - the status changes that are allowed, anything else is ignored.
+// e.g. once Close() has moved the status to Closing, a reconnect that completes afterwards can't move it back to Connected.
+var transitions = map[Status][]Status{
+	NotConnected: {Listening, Connecting, Closing},
+	Listening:    {Connected, Error, Closing},
+	Connecting:   {Connected, Closed, Error, Closing},
+	Connected:    {Disconnected, ReConnecting, Error, Closing},
+	ReConnecting: {Connected, Timeout, Error, Closing},
+	Disconnected: {Connected, Error, Closing},
+	Timeout:      {Closed, Closing},
+	Error:        {Closed, Closing},
+	Closing:      {Closed},
+	Closed:       {},
+}
+
+func legalTransition(from Status, to Status) bool {
+
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setStatus - changes the status of the connection and emits an event, without notifying Read().
+// Returns false if the change isn't allowed from the current status.
+func (s *Server) setStatus(status Status) bool {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	old := s.status
+	if !legalTransition(old, status) {
+		return false
+	}
+
+	s.status = status
+
+	if status == Closing && s.closing != nil {
+		close(s.closing)
+	}
+
+	if s.statusChanged != nil {
+		close(s.statusChanged)
+		s.statusChanged = nil
+	}
+
+	sendEvent(s.events, s.recorder, Event{Status: status, OldStatus: old, Peer: s.peer})
+
+	return true
+}
+
+// statusChange - changes the status of the connection and notifies both Events() and Read()
+func (s *Server) statusChange(status Status) {
+
+	if s.setStatus(status) {
+		s.notify(status)
+	}
+}
+
+// notify - returns the status from Read(), unless ServerConfig.SuppressStatus is set
+func (s *Server) notify(status Status) {
+
+	if !s.noStatus {
+		s.deliver(&Message{Status: status.String(), MsgType: -1})
+	}
+}
+
+// getStatus - get the current status of the connection
+func (s *Server) getStatus() Status {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.status
+}
+
+// WaitForStatus - blocks until the server has the status or ctx ends
+func (s *Server) WaitForStatus(ctx context.Context, status Status) error {
+
+	for {
+
+		s.mutex.Lock()
+
+		if s.status == status {
+			s.mutex.Unlock()
+			return nil
+		}
+
+		if s.statusChanged == nil {
+			s.statusChanged = make(chan struct{})
+		}
+		changed := s.statusChanged
+
+		s.mutex.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// setStatus - changes the status of the connection and emits an event, without notifying Read().
+// Returns false if the change isn't allowed from the current status.
+func (c *Client) setStatus(status Status) bool {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	old := c.status
+	if !legalTransition(old, status) {
+		return false
+	}
+
+	c.status = status
+
+	if status == Closing && c.closing != nil {
+		close(c.closing)
+	}
+
+	if c.statusChanged != nil {
+		close(c.statusChanged)
+		c.statusChanged = nil
+	}
+
+	sendEvent(c.events, c.recorder, Event{Status: status, OldStatus: old, Peer: c.peer})
+
+	return true
+}
+
+// statusChange - changes the status of the connection and notifies both Events() and Read()
+func (c *Client) statusChange(status Status) {
+
+	if c.setStatus(status) {
+		c.notify(status)
+	}
+}
+
+// notify - returns the status from Read(), unless ClientConfig.SuppressStatus is set
+func (c *Client) notify(status Status) {
+
+	if !c.noStatus {
+		c.deliver(&Message{Status: status.String(), MsgType: -1})
+	}
+}
+
+// getStatus - get the current status of the connection
+func (c *Client) getStatus() Status {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.status
+}
+
+// WaitForStatus - blocks until the client has the status or ctx ends
+func (c *Client) WaitForStatus(ctx context.Context, status Status) error {
+
+	for {
+
+		c.mutex.Lock()
+
+		if c.status == status {
+			c.mutex.Unlock()
+			return nil
+		}
+
+		if c.statusChanged == nil {
+			c.statusChanged = make(chan struct{})
+		}
+		changed := c.statusChanged
+
+		c.mutex.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
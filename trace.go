@@ -0,0 +1,121 @@
+package ipc
+
+import (
+	"context"
+	"errors"
+)
+
+// Tracer - moves trace context between a context.Context and the W3C traceparent/tracestate values sent with each message.
+// Implement it to plug in OpenTelemetry or another tracing library, pass it in ServerConfig.Tracer or ClientConfig.Tracer.
+type Tracer interface {
+	Inject(ctx context.Context) (traceParent string, traceState string)                 // called by WriteContext()
+	Extract(ctx context.Context, traceParent string, traceState string) context.Context // called for each message received
+}
+
+type traceContextKey struct{}
+
+type traceContext struct {
+	parent string
+	state  string
+}
+
+// ContextWithTrace - returns a copy of ctx carrying the traceparent and tracestate, used when no Tracer is configured
+func ContextWithTrace(ctx context.Context, traceParent string, traceState string) context.Context {
+
+	return context.WithValue(ctx, traceContextKey{}, traceContext{parent: traceParent, state: traceState})
+}
+
+// TraceFromContext - returns the traceparent and tracestate set by ContextWithTrace
+func TraceFromContext(ctx context.Context) (traceParent string, traceState string) {
+
+	tc, _ := ctx.Value(traceContextKey{}).(traceContext)
+
+	return tc.parent, tc.state
+}
+
+// contextTracer - the default Tracer, uses ContextWithTrace and TraceFromContext
+type contextTracer struct{}
+
+func (contextTracer) Inject(ctx context.Context) (string, string) {
+	return TraceFromContext(ctx)
+}
+
+func (contextTracer) Extract(ctx context.Context, traceParent string, traceState string) context.Context {
+	return ContextWithTrace(ctx, traceParent, traceState)
+}
+
+// Context - returns the context extracted from the trace details received with the message
+func (m *Message) Context() context.Context {
+
+	if m.ctx == nil {
+		return context.Background()
+	}
+
+	return m.ctx
+}
+
+// traceHeaders - returns a copy of the headers with the trace context from ctx added, used by WriteContext()
+func traceHeaders(tracer Tracer, ctx context.Context, headers map[string]string) (map[string]string, error) {
+
+	parent, state := tracer.Inject(ctx)
+	if parent == "" {
+		return headers, nil
+	}
+
+	if !validTraceParent(parent) {
+		return nil, errors.New("traceparent is not valid")
+	}
+
+	h := make(map[string]string, len(headers)+2)
+	for k, v := range headers {
+		h[k] = v
+	}
+
+	h[HeaderTraceParent] = parent
+	if state != "" {
+		h[HeaderTraceState] = state
+	}
+
+	return h, nil
+}
+
+// newMessage - creates the message returned by Read(), extracting any trace context from the headers
+func newMessage(tracer Tracer, msgType int, data []byte, headers map[string]string) *Message {
+
+	m := &Message{MsgType: msgType, Data: data, Headers: headers, Deadline: deadline(headers)}
+
+	// the deadline is in Deadline, so it isn't passed on if the headers are written again
+	if _, ok := headers[HeaderDeadline]; ok {
+		delete(headers, HeaderDeadline)
+		if len(headers) == 0 {
+			m.Headers = nil
+		}
+	}
+
+	if parent := headers[HeaderTraceParent]; validTraceParent(parent) {
+		m.TraceParent = parent
+		m.TraceState = headers[HeaderTraceState]
+		m.ctx = tracer.Extract(context.Background(), m.TraceParent, m.TraceState)
+	}
+
+	return m
+}
+
+// validTraceParent - checks the format is version-traceid-parentid-flags, e.g. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func validTraceParent(p string) bool {
+
+	if len(p) < 55 || p[2] != '-' || p[35] != '-' || p[52] != '-' {
+		return false
+	}
+
+	for i, r := range p[:55] {
+		if i == 2 || i == 35 || i == 52 {
+			continue
+		}
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f') {
+			return false
+		}
+	}
+
+	return len(p) == 55 || p[55] == '-'
+}
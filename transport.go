@@ -0,0 +1,29 @@
+package ipc
+
+import "net"
+
+// Transport - replaces the unix socket or named pipe the server listens on and the client connects to,
+// e.g. the in-memory transport in the ipctest package. Set it with WithTransport() or the Transport field of the config.
+// Shared memory and passing files need a unix socket, so can't be used with a Transport.
+type Transport interface {
+	Listen(name string) (net.Listener, error) // called once by the server
+	Dial(name string) (net.Conn, error)       // called by the client for each attempt to connect, an error means the server isn't listening yet
+}
+
+// listenTransport - the same as run(), but listens with the Transport instead of the socket or named pipe
+func (s *Server) listenTransport() error {
+
+	listen, err := s.transport.Listen(s.name)
+	if err != nil {
+		return err
+	}
+
+	s.listen = listen
+
+	s.setStatus(Listening)
+
+	s.wg.Add(1)
+	go s.acceptLoop()
+
+	return nil
+}
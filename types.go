@@ -1,39 +1,109 @@
 package ipc
 
 import (
+	"context"
 	"crypto/cipher"
 	"net"
+	"os"
+	"sync"
 	"time"
 )
 
 // Server - holds the details of the server connection & config.
 type Server struct {
-	name       string
-	listen     net.Listener
-	conn       net.Conn
-	status     Status
-	received   chan (*Message)
-	toWrite    chan (*Message)
-	timeout    time.Duration
-	encryption bool
-	maxMsgSize int
-	enc        *encryption
-	unMask     bool
+	name         string
+	listen       net.Listener
+	conn         net.Conn
+	status       Status
+	received     chan (*Message)
+	toWrite      chan (*Message) // PriorityNormal
+	toWriteHigh  chan (*Message)
+	toWriteLow   chan (*Message)
+	timeout      time.Duration
+	encryption   bool
+	maxMsgSize   int
+	enc          *encryption
+	unMask       bool
+	events       chan (Event)
+	noStatus     bool
+	peer         *Peer
+	stats        *stats
+	metrics      Metrics
+	tracer       Tracer
+	peerCaps     byte
+	wg           sync.WaitGroup
+	writePolicy  WritePolicy
+	maxBatch     int
+	batchLatency time.Duration
+	shmSize      int
+	onExpired    func(*Message)
+	lastClientID string      // ID of the last client to connect, used to set Peer.Returning
+	transport    Transport   // nil to use the unix socket or named pipe
+	recorder     Recorder    // nil if nothing is being recorded
+	registered   *ServerInfo // the server's entry in the registry, nil if it isn't announced, see WithService()
+	registryDir  string
+	activated    bool // the listener was passed by systemd, see WithSocketActivation()
+
+	mutex         sync.Mutex    // guards status, conn, peer, peerCaps, registered and closeStatus
+	statusChanged chan struct{} // closed when the status changes, see WaitForStatus()
+
+	closing     chan struct{} // closed when the status moves to Closing, so nothing waits for Read() any more, see deliver()
+	closed      chan struct{} // closed once the connection has been closed by Close() or Shutdown(), ends Read(), see closeRead()
+	closeStatus bool          // the Closed status is still to be returned by Read()
+	closeErr    error         // returned by Read() once closed is closed
+	closeOnce   sync.Once
 }
 
 // Client - holds the details of the client connection and config.
 type Client struct {
-	Name          string
-	conn          net.Conn
-	status        Status
-	timeout       float64       //
-	retryTimer    time.Duration // number of seconds before trying to connect again
-	received      chan (*Message)
-	toWrite       chan (*Message)
-	encryption    bool
-	encryptionReq bool
-	maxMsgSize    int
-	enc           *encryption
+	Name            string
+	conn            net.Conn
+	status          Status
+	timeout         time.Duration   // how long to keep trying to connect, 0 is forever
+	reconnectPolicy ReconnectPolicy // how long to wait before trying to connect again, and when to give up
+	noReconnect     bool            // don't reconnect once the connection has been lost
+	id              string          // sent to the server after each handshake, see hello()
+	transport       Transport       // nil to use the unix socket or named pipe
+	clock           Clock
+	received        chan (*Message)
+	toWrite         chan (*Message) // PriorityNormal
+	toWriteHigh     chan (*Message)
+	toWriteLow      chan (*Message)
+	encryption      bool
+	encryptionReq   bool
+	maxMsgSize      int
+	enc             *encryption
+	events          chan (Event)
+	noStatus        bool
+	peer            *Peer
+	stats           *stats
+	metrics         Metrics
+	tracer          Tracer
+	wg              sync.WaitGroup
+	writePolicy     WritePolicy
+	maxBatch        int
+	batchLatency    time.Duration
+	shm             bool
+	onExpired       func(*Message)
+	recorder        Recorder // nil if nothing is being recorded
+
+	mutex         sync.Mutex    // guards status, conn, peer, maxMsgSize and closeStatus
+	statusChanged chan struct{} // closed when the status changes, see WaitForStatus()
+
+	closing     chan struct{} // closed when the status moves to Closing, so nothing waits for Read() any more, see deliver()
+	closed      chan struct{} // closed once the connection has been closed by Close() or Shutdown(), ends Read(), see closeRead()
+	closeStatus bool          // the Closed status is still to be returned by Read()
+	closeErr    error         // returned by Read() once closed is closed
+	closeOnce   sync.Once
+}
+
+// session - a single connection, shared by its read and write goroutines until it ends
+type session struct {
+	conn     net.Conn
+	cipher   cipher.AEAD      // nil if the connection isn't encrypted
+	peerCaps uint32           // capabilities of the other end, see control.go, read with caps()
+	done     chan struct{}    // closed when the read goroutine exits
+	chunks   [numLanes][]byte // chunked messages being received, see addChunk()
 }
 
 // Message - contains the received message
@@ -42,6 +112,39 @@ type Message struct {
 	MsgType int    // 0 = reserved , -1 is an internal message (disconnection or error etc), all messages recieved will be > 0
 	Data    []byte // message data received
 	Status  string // the status of the connection
+
+	Headers     map[string]string // optional key/value headers sent with the message, see WriteMessage()
+	TraceParent string            // W3C traceparent received with the message, see WriteContext()
+	TraceState  string            // W3C tracestate received with the message
+	Files       []*os.File        // files sent with the message, see WriteWithFiles(). The receiver owns them and should close them
+	Priority    Priority          // the order queued messages are written in, see WriteMessage() and WritePriority()
+	Deadline    time.Time         // when the message expires, zero if it doesn't, see WithDeadline()
+
+	ctx   context.Context
+	ttl   time.Duration // set by WithTTL(), turned into the Deadline when the message is written
+	batch []*Message    // set on the message queued by WriteBatch()
+	buf   *[]byte       // pooled buffer holding Data, see Release()
+}
+
+// Event - a change to the connection, delivered on the channel returned by Events()
+type Event struct {
+	Status    Status // the status of the connection after the change
+	OldStatus Status // the status of the connection before the change
+	Err       error  // details of any error, nil if the event is a status change
+	Peer      *Peer  // details of the other end of the connection, nil if not connected
+
+	Attempt   int           // the number of the failed attempt to connect, 0 if the event isn't about one. The status doesn't change
+	NextDelay time.Duration // how long the client waits before the next attempt
+}
+
+// Peer - details of the other end of the connection
+type Peer struct {
+	Addr       string // address of the socket or named pipe
+	Encryption bool   // whether the connection is encrypted
+	MaxMsgSize int    // the maximum message size agreed during the handshake
+
+	ClientID  string // the ID the client sent, on the server only. Empty if the client is too old to send one
+	Returning bool   // the client has the same ID as the last client to connect, see ClientConfig.ClientID
 }
 
 // Status - Status of the connection
@@ -76,15 +179,59 @@ type ServerConfig struct {
 	MaxMsgSize        int
 	Encryption        bool
 	UnmaskPermissions bool
+	SuppressStatus    bool
+	Metrics           Metrics
+	Tracer            Tracer
+	WriteBuffer       int            // number of messages Write() can queue before the policy applies (default is 0, unbuffered)
+	WritePolicy       WritePolicy    // what Write() does when the buffer is full (default is WriteBlock)
+	MaxBatch          int            // most messages written in a single flush (default is 64)
+	BatchLatency      time.Duration  // how long the writer waits for more messages before flushing (default is 0, don't wait)
+	SharedMemory      int            // size in bytes of each shared memory ring offered to clients that ask for it, linux only (default is 0, always use the socket)
+	OnExpired         func(*Message) // called with each message received after its deadline, before it is discarded (default is nil)
+	Transport         Transport      // listen with this instead of the unix socket or named pipe (default is nil)
+	Recorder          Recorder       // called for each message sent and received, and each status change (default is nil)
+	Service           string         // the application protocol announced in the registry so clients can find the server, see ListServers() (default is "", not announced)
+	ServiceVersion    string         // the version of the protocol announced with Service
+	RegistryDir       string         // directory of the registry (default is /tmp/golang-ipc-<uid>, or golang-ipc in the temp directory on windows)
+	SocketActivation  bool           // listen on the unix socket passed by systemd instead of creating one, linux only (default is false)
 }
 
 // ClientConfig - used to pass configuation overrides to ClientStart()
 type ClientConfig struct {
-	Timeout    float64
-	RetryTimer time.Duration
-	Encryption bool
+	Timeout        float64
+	RetryTimer     time.Duration
+	Encryption     bool
+	SuppressStatus bool
+	Metrics        Metrics
+	Tracer         Tracer
+	WriteBuffer    int            // number of messages Write() can queue before the policy applies (default is 0, unbuffered)
+	WritePolicy    WritePolicy    // what Write() does when the buffer is full (default is WriteBlock)
+	MaxBatch       int            // most messages written in a single flush (default is 64)
+	BatchLatency   time.Duration  // how long the writer waits for more messages before flushing (default is 0, don't wait)
+	SharedMemory   bool           // ask the server to send messages through shared memory instead of the socket, linux only (default is false)
+	OnExpired      func(*Message) // called with each message received after its deadline, before it is discarded (default is nil)
+
+	ReconnectPolicy  ReconnectPolicy // how long to wait between attempts to connect, and when to give up (default is ConstantBackoff with the RetryTimer)
+	DisableReconnect bool            // move to Disconnected instead of reconnecting when the connection is lost (default is false)
+	ClientID         string          // sent to the server each time the client connects, up to 256 bytes (default is a random ID that lasts as long as the client)
+	Transport        Transport       // connect with this instead of the unix socket or named pipe (default is nil)
+	Clock            Clock           // used for the timeout, reconnect policy and message deadlines (default is the system clock)
+	Recorder         Recorder        // called for each message sent and received, and each status change (default is nil)
+	RegistryDir      string          // directory of the registry searched by StartServiceClient() (default is /tmp/golang-ipc-<uid>, or golang-ipc in the temp directory on windows)
 }
 
+// WritePolicy - what Write() does when the outbound buffer is full
+type WritePolicy int
+
+const (
+	// WriteBlock - wait until there is space in the buffer
+	WriteBlock WritePolicy = iota
+	// WriteFailFast - return ErrQueueFull straight away
+	WriteFailFast
+	// WriteDropOldest - discard the oldest queued message to make space, needs a WriteBuffer of at least 1
+	WriteDropOldest
+)
+
 // Encryption - encryption settings
 type encryption struct {
 	keyExchange string
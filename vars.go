@@ -1,5 +1,26 @@
 package ipc
 
-const version = 2 // ipc package version
+import (
+	"errors"
+	"time"
+
+	"github.com/james-barrow/golang-ipc/wire"
+)
+
+const version = wire.Version // ipc package version
 
 const maxMsgSize = 3145728 // 3Mb  - Maximum bytes allowed for each message
+
+const retryTimer = 20 * time.Second // default wait between attempts to connect
+
+const maxBatch = 64 // default maximum number of messages coalesced into a single flush
+
+const minSharedMemory = 4096 // smallest ring buffer used by the shared memory transport
+
+// handshakeTimeout - how long the other end has to finish the handshake before the connection is dropped, a var so tests can shorten it
+var handshakeTimeout = 10 * time.Second
+
+const eventBuffer = 32 // number of events held for Events() before new ones are dropped
+
+// ErrQueueFull - returned by Write() with WriteFailFast, and TryWrite(), when the outbound buffer is full
+var ErrQueueFull = errors.New("write queue is full")
@@ -0,0 +1,145 @@
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// EncodeHeaders - the data of a CtrlHeaders control message after the code,
+// [2 byte count] then for each entry [2 byte key length][key][2 byte value length][value], sorted by key
+func EncodeHeaders(headers map[string]string) []byte {
+
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(len(keys)))
+
+	for _, k := range keys {
+		b = appendString(b, k)
+		b = appendString(b, headers[k])
+	}
+
+	return b
+}
+
+// DecodeHeaders - the reverse of EncodeHeaders()
+func DecodeHeaders(b []byte) (map[string]string, error) {
+
+	if len(b) < 2 {
+		return nil, errors.New("headers are too short")
+	}
+
+	count := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+
+	headers := make(map[string]string, count)
+
+	for i := 0; i < count; i++ {
+
+		k, rest, err := readString(b)
+		if err != nil {
+			return nil, err
+		}
+
+		v, rest, err := readString(rest)
+		if err != nil {
+			return nil, err
+		}
+
+		headers[k] = v
+		b = rest
+	}
+
+	return headers, nil
+}
+
+// ValidHeaders - keys and values have to fit in their 2 byte length prefix, and all of them in MaxHeadersSize
+func ValidHeaders(headers map[string]string) error {
+
+	if len(headers) > 0xffff {
+		return errors.New("too many headers")
+	}
+
+	size := 2
+
+	for k, v := range headers {
+		if len(k) > 0xffff || len(v) > 0xffff {
+			return errors.New("header key or value is too long")
+		}
+		size += 4 + len(k) + len(v)
+	}
+
+	if size > MaxHeadersSize {
+		return errors.New("headers are too long")
+	}
+
+	return nil
+}
+
+func appendString(b []byte, s string) []byte {
+
+	l := make([]byte, 2)
+	binary.BigEndian.PutUint16(l, uint16(len(s)))
+
+	return append(append(b, l...), s...)
+}
+
+func readString(b []byte) (string, []byte, error) {
+
+	if len(b) < 2 {
+		return "", nil, errors.New("headers are too short")
+	}
+
+	l := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+l {
+		return "", nil, errors.New("headers are too short")
+	}
+
+	return string(b[2 : 2+l]), b[2+l:], nil
+}
+
+// Chunk - part of a large message in a CtrlChunk control message, [CtrlChunk][lane][1 if last][4 byte msgType][data].
+// Messages are split up so higher priority messages can be sent in between, the chunks of each lane are put back together in order.
+type Chunk struct {
+	Lane    int // 0 is the highest priority
+	Last    bool
+	MsgType int
+	Data    []byte
+}
+
+// ChunkHeader - the bytes before the data of a chunk, including the control code
+const ChunkHeader = 7
+
+// AppendChunk - appends the data of the control message, including the control code, to dst
+func AppendChunk(dst []byte, c Chunk) []byte {
+
+	var last byte
+	if c.Last {
+		last = 1
+	}
+
+	dst = append(dst, CtrlChunk, byte(c.Lane), last, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(dst[len(dst)-4:], uint32(c.MsgType))
+
+	return append(dst, c.Data...)
+}
+
+// ParseChunk - the chunk in the data of a control message after the control code, Data is part of b
+func ParseChunk(b []byte) (Chunk, error) {
+
+	if len(b) < ChunkHeader-1 {
+		return Chunk{}, errors.New("invalid message chunk")
+	}
+
+	return Chunk{
+		Lane:    int(b[0]),
+		Last:    b[1] == 1,
+		MsgType: int(binary.BigEndian.Uint32(b[2:6])),
+		Data:    b[6:],
+	}, nil
+}
@@ -0,0 +1,206 @@
+package wire
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+)
+
+// Frame - a message type and its data, MsgType 0 is a control message
+type Frame struct {
+	MsgType int
+	Data    []byte
+}
+
+// AppendFrame - appends [length][msgType + data] to dst, the msgType and data are encrypted in place if g is not nil
+func AppendFrame(dst []byte, g cipher.AEAD, msgType int, data []byte) ([]byte, error) {
+
+	size := 4 + 4 + len(data)
+	if g != nil {
+		size += g.NonceSize() + g.Overhead()
+	}
+	dst = grow(dst, size)
+
+	start := len(dst)
+	dst = append(dst, 0, 0, 0, 0)
+
+	plain := len(dst)
+	if g != nil {
+		plain += g.NonceSize()
+		dst = dst[:plain]
+
+		if _, err := io.ReadFull(rand.Reader, dst[start+4:plain]); err != nil {
+			return nil, err
+		}
+	}
+
+	dst = append(dst, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(dst[plain:], uint32(msgType))
+	dst = append(dst, data...)
+
+	if g != nil {
+		// sealing over the plaintext reuses its storage, the capacity for the tag is already there
+		dst = g.Seal(dst[:plain], dst[start+4:plain], dst[plain:], nil)
+	}
+
+	binary.BigEndian.PutUint32(dst[start:], uint32(len(dst)-start-4))
+
+	return dst, nil
+}
+
+// OpenFrame - decrypts a payload in place, b is [nonce][sealed]
+func OpenFrame(g cipher.AEAD, b []byte) ([]byte, error) {
+
+	nonceSize := g.NonceSize()
+	if len(b) < nonceSize {
+		return nil, &DecryptError{Err: errNotEnoughData}
+	}
+
+	plain, err := g.Open(b[nonceSize:nonceSize], b[:nonceSize], b[nonceSize:], nil)
+	if err != nil {
+		return nil, &DecryptError{Err: err}
+	}
+
+	return plain, nil
+}
+
+// FrameLength - the length prefix of a frame.
+// An error if it's too short to hold a message type or longer than the peer is allowed to send, so a bad length can't exhaust memory.
+func FrameLength(prefix []byte, maxMsgSize int) (int, error) {
+
+	if len(prefix) < 4 {
+		return 0, ErrFrameTooShort
+	}
+
+	l := int(binary.BigEndian.Uint32(prefix))
+
+	if l < 4 {
+		return 0, ErrFrameTooShort
+	}
+
+	if l > maxMsgSize+FrameOverhead {
+		return 0, ErrFrameTooLong
+	}
+
+	return l, nil
+}
+
+// SplitFrame - the message type and data of a decrypted payload
+func SplitFrame(b []byte) (int, []byte, error) {
+
+	if len(b) < 4 {
+		return 0, nil, ErrFrameTooShort
+	}
+
+	return int(binary.BigEndian.Uint32(b)), b[4:], nil
+}
+
+// DecryptError - a frame couldn't be decrypted. The frame has been read in full, so the stream is still in step
+type DecryptError struct {
+	Err error
+}
+
+func (e *DecryptError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DecryptError) Unwrap() error {
+	return e.Err
+}
+
+// Encoder - writes frames to w, encrypted if g is not nil
+type Encoder struct {
+	w   io.Writer
+	g   cipher.AEAD
+	buf []byte
+}
+
+// NewEncoder - frames are encrypted if g is not nil
+func NewEncoder(w io.Writer, g cipher.AEAD) *Encoder {
+
+	return &Encoder{w: w, g: g}
+}
+
+// Encode - writes f in a single call to Write()
+func (e *Encoder) Encode(f Frame) error {
+
+	b, err := AppendFrame(e.buf[:0], e.g, f.MsgType, f.Data)
+	if err != nil {
+		return err
+	}
+	e.buf = b
+
+	_, err = e.w.Write(b)
+	return err
+}
+
+// Decoder - reads frames from r, decrypting them if g is not nil
+type Decoder struct {
+	r          io.Reader
+	g          cipher.AEAD
+	maxMsgSize int
+	prefix     [4]byte
+
+	// Alloc - returns a buffer of length n to read the next frame into, the Data of the frame returned is part of it.
+	// The default allocates a new buffer for each frame.
+	Alloc func(n int) []byte
+}
+
+// NewDecoder - maxMsgSize is the max message length agreed in the handshake, longer frames are rejected with ErrFrameTooLong
+func NewDecoder(r io.Reader, g cipher.AEAD, maxMsgSize int) *Decoder {
+
+	return &Decoder{r: r, g: g, maxMsgSize: maxMsgSize}
+}
+
+// Decode - reads the next frame.
+// Errors reading from r are returned as they are. A *DecryptError means the frame was skipped and the next one can be read,
+// ErrFrameTooShort or ErrFrameTooLong means the stream can't be trusted any more.
+func (d *Decoder) Decode() (Frame, error) {
+
+	if _, err := io.ReadFull(d.r, d.prefix[:]); err != nil {
+		return Frame{}, err
+	}
+
+	n, err := FrameLength(d.prefix[:], d.maxMsgSize)
+	if err != nil {
+		return Frame{}, err
+	}
+
+	var b []byte
+	if d.Alloc != nil {
+		b = d.Alloc(n)
+	} else {
+		b = make([]byte, n)
+	}
+
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		return Frame{}, err
+	}
+
+	if d.g != nil {
+		if b, err = OpenFrame(d.g, b); err != nil {
+			return Frame{}, err
+		}
+	}
+
+	msgType, data, err := SplitFrame(b)
+	if err != nil {
+		return Frame{}, err
+	}
+
+	return Frame{MsgType: msgType, Data: data}, nil
+}
+
+// grow - makes sure there is room to append n more bytes to b without reallocating
+func grow(b []byte, n int) []byte {
+
+	if cap(b)-len(b) >= n {
+		return b
+	}
+
+	nb := make([]byte, len(b), 2*cap(b)+n)
+	copy(nb, b)
+
+	return nb
+}
@@ -0,0 +1,161 @@
+package wire
+
+import (
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// The handshake, before any frames are sent:
+//
+//  1. server -> ServerHello, [version][1 if encrypted]
+//  2. client -> [reply code], see ReplyOK
+//  3. if encrypted, server -> public key then client -> public key, see MarshalPublicKey().
+//     Both ends take the sha256 of the x coordinate of the shared point as the AES-256-GCM key
+//  4. server -> the max message length, see AppendMaxMsgSize()
+//  5. client -> [capabilities], see CapHeaders. Older clients reply 0
+//  6. if the client has CapSharedMemory, server -> [1] with the memfd attached, or [0] to carry on using the socket
+//
+// Then a client with CapClientID sends a CtrlHello frame, and the server sends a CtrlCaps frame to clients with CapHeaders.
+
+// Reply codes sent by the client after the ServerHello
+const (
+	ReplyOK         = 0
+	ReplyVersion    = 1 // the client has a different version number
+	ReplyEncryption = 2 // the client insists on encryption and the server isn't using it
+	ReplyFailed     = 3
+)
+
+// ServerHello - the first message of the handshake
+type ServerHello struct {
+	Version    byte
+	Encryption bool
+}
+
+// MarshalBinary - [version][1 if encrypted]
+func (h ServerHello) MarshalBinary() ([]byte, error) {
+
+	b := []byte{h.Version, 0}
+	if h.Encryption {
+		b[1] = 1
+	}
+
+	return b, nil
+}
+
+// UnmarshalBinary - any non-zero encryption byte means encrypted
+func (h *ServerHello) UnmarshalBinary(b []byte) error {
+
+	if len(b) != 2 {
+		return errors.New("server hello is the wrong size")
+	}
+
+	h.Version = b[0]
+	h.Encryption = b[1] != 0
+
+	return nil
+}
+
+// PublicKeySize - the length of a public key sent during the key exchange
+const PublicKeySize = 97
+
+// MarshalPublicKey - an uncompressed P-384 point, nil if pub isn't a valid key
+func MarshalPublicKey(pub *ecdsa.PublicKey) []byte {
+
+	if pub == nil || pub.X == nil || pub.Y == nil {
+		return nil
+	}
+
+	return elliptic.Marshal(elliptic.P384(), pub.X, pub.Y)
+}
+
+// UnmarshalPublicKey - the reverse of MarshalPublicKey(), an error if b isn't a point on the curve
+func UnmarshalPublicKey(b []byte) (*ecdsa.PublicKey, error) {
+
+	if len(b) != PublicKeySize {
+		return nil, errors.New("public key received isn't valid length")
+	}
+
+	// Unmarshal returns nil for anything that isn't a point on the curve
+	x, y := elliptic.Unmarshal(elliptic.P384(), b)
+	if x == nil {
+		return nil, errors.New("didn't received valid public key")
+	}
+
+	return &ecdsa.PublicKey{Curve: elliptic.P384(), X: x, Y: y}, nil
+}
+
+// AppendMaxMsgSize - appends [4 byte length][4 byte max message length] to dst,
+// the max message length is encrypted as [nonce][sealed] if g is not nil
+func AppendMaxMsgSize(dst []byte, g cipher.AEAD, size int) ([]byte, error) {
+
+	buff := make([]byte, 4)
+	binary.BigEndian.PutUint32(buff, uint32(size))
+
+	if g != nil {
+		nonce := make([]byte, g.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return nil, err
+		}
+		buff = g.Seal(nonce, nonce, buff, nil)
+	}
+
+	l := make([]byte, 4)
+	binary.BigEndian.PutUint32(l, uint32(len(buff)))
+
+	return append(append(dst, l...), buff...), nil
+}
+
+// ReadMaxMsgSize - reads the max message length sent by AppendMaxMsgSize(), anything under 1024 or over MaxMsgSizeCap is an error
+func ReadMaxMsgSize(r io.Reader, g cipher.AEAD) (int, error) {
+
+	buff := make([]byte, 4)
+
+	if _, err := io.ReadFull(r, buff); err != nil {
+		return 0, errors.New("failed to received max message length 1")
+	}
+
+	// 4 bytes, plus the nonce and tag if it's encrypted
+	msgLen := binary.BigEndian.Uint32(buff)
+	if msgLen < 4 || msgLen > 64 {
+		return 0, errors.New("max message length is the wrong size")
+	}
+
+	buff = make([]byte, int(msgLen))
+
+	if _, err := io.ReadFull(r, buff); err != nil {
+		return 0, errors.New("failed to received max message length 2")
+	}
+
+	if g != nil {
+		nonceSize := g.NonceSize()
+		if len(buff) < nonceSize {
+			return 0, errors.New("failed to received max message length 3")
+		}
+
+		var err error
+		buff, err = g.Open(nil, buff[:nonceSize], buff[nonceSize:], nil)
+		if err != nil {
+			return 0, errors.New("failed to received max message length 3")
+		}
+	}
+
+	if len(buff) != 4 {
+		return 0, errors.New("max message length is the wrong size")
+	}
+
+	maxMsgSize := binary.BigEndian.Uint32(buff)
+	if maxMsgSize < 1024 {
+		return 0, errors.New("server sent a max message length under 1024 bytes")
+	}
+
+	if maxMsgSize > MaxMsgSizeCap {
+		return 0, errors.New("server sent a max message length over the cap")
+	}
+
+	return int(maxMsgSize), nil
+}
@@ -0,0 +1,48 @@
+// Package wire - the wire format used between an ipc server and client, for tools such as sniffers and proxies
+// that need to understand it, and for testing implementations in other languages.
+//
+// After the handshake (see handshake.go) everything is sent in frames, [4 byte length][payload].
+// The payload is [4 byte message type][data], encrypted with AES-GCM as [nonce][sealed payload] if encryption was agreed.
+// All integers are big endian. Message type 0 is a control message, the first byte of the data is the control code.
+package wire
+
+import "errors"
+
+// Version - the protocol version sent by the server in the first byte of the handshake
+const Version = 2
+
+// Control codes, the first byte of the data of a control message (message type 0).
+// Peers that don't recognise a control code ignore the message.
+const (
+	CtrlHeaders = 1 // key/value headers that apply to the next message sent, see EncodeHeaders()
+	CtrlGoodbye = 2 // the connection is being shut down, the peer shouldn't try to reconnect
+	CtrlFiles   = 3 // [count] the number of files sent with SCM_RIGHTS that belong to the next message
+	CtrlChunk   = 4 // part of a large message, see Chunk
+	CtrlCaps    = 5 // [caps] the server's capabilities, sent to clients with CapHeaders before any other message
+	CtrlHello   = 6 // [client ID] sent by clients with CapClientID before any other message
+)
+
+// Capabilities the client sends in its reply to the max message length during the handshake.
+// The server sends its own in a CtrlCaps control message.
+const (
+	CapHeaders      = 1  // understands control messages and message headers
+	CapSharedMemory = 2  // wants to use the shared memory transport, the server replies with one more byte
+	CapFiles        = 4  // can receive files sent with SCM_RIGHTS
+	CapChunks       = 8  // can put together messages sent in chunks
+	CapClientID     = 16 // sends its ID in a CtrlHello control message as soon as the handshake has finished
+)
+
+// Limits
+const (
+	MaxHeadersSize = 60 * 1024 // most bytes the encoded headers sent with a message can take up
+	FrameOverhead  = 64 * 1024 // room in a frame on top of the max message size, for the message type, headers, chunk prefix, nonce and tag
+	MaxClientID    = 256       // longest client ID, in bytes
+	MaxMsgSizeCap  = 1 << 30   // largest max message length a server can set, clients reject anything bigger
+)
+
+var (
+	ErrFrameTooShort = errors.New("frame is too short")                   // the length prefix or payload is too short to hold a message type
+	ErrFrameTooLong  = errors.New("frame exceeds maximum message length") // the length prefix is longer than the peer is allowed to send
+
+	errNotEnoughData = errors.New("not enough data to decrypt")
+)
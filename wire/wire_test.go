@@ -0,0 +1,389 @@
+package wire
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func testCipher(t *testing.T) cipher.AEAD {
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := cipher.NewGCM(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return g
+}
+
+func TestEncodeDecode(t *testing.T) {
+
+	for _, g := range []cipher.AEAD{nil, testCipher(t)} {
+
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf, g)
+
+		frames := []Frame{{MsgType: 5, Data: []byte("hello")}, {MsgType: 0, Data: []byte{CtrlGoodbye}}, {MsgType: 7, Data: nil}}
+		for _, f := range frames {
+			if err := enc.Encode(f); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		dec := NewDecoder(&buf, g, 1024)
+		for _, want := range frames {
+			f, err := dec.Decode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.MsgType != want.MsgType || !bytes.Equal(f.Data, want.Data) {
+				t.Errorf("got %d %q, want %d %q", f.MsgType, f.Data, want.MsgType, want.Data)
+			}
+		}
+
+		if _, err := dec.Decode(); err != io.EOF {
+			t.Errorf("expected io.EOF once the frames have been read, got %v", err)
+		}
+	}
+}
+
+func TestDecoderAlloc(t *testing.T) {
+
+	var buf bytes.Buffer
+	NewEncoder(&buf, nil).Encode(Frame{MsgType: 1, Data: []byte("pooled")})
+
+	var allocated []byte
+	dec := NewDecoder(&buf, nil, 1024)
+	dec.Alloc = func(n int) []byte {
+		allocated = make([]byte, n)
+		return allocated
+	}
+
+	f, err := dec.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(allocated) != 10 || &f.Data[0] != &allocated[4] {
+		t.Error("the frame should be read into the buffer returned by Alloc")
+	}
+}
+
+func TestDecodeTooLong(t *testing.T) {
+
+	var buf bytes.Buffer
+	NewEncoder(&buf, nil).Encode(Frame{MsgType: 1, Data: make([]byte, 2048)})
+
+	if _, err := NewDecoder(&buf, nil, 2048).Decode(); err != nil {
+		t.Fatal(err)
+	}
+
+	prefix := make([]byte, 4)
+	binary.BigEndian.PutUint32(prefix, uint32(1024+FrameOverhead+1))
+
+	if _, err := NewDecoder(bytes.NewReader(prefix), nil, 1024).Decode(); err != ErrFrameTooLong {
+		t.Errorf("expected ErrFrameTooLong, got %v", err)
+	}
+
+	binary.BigEndian.PutUint32(prefix, 3)
+
+	if _, err := NewDecoder(bytes.NewReader(append(prefix, 0, 0, 0)), nil, 1024).Decode(); err != ErrFrameTooShort {
+		t.Errorf("expected ErrFrameTooShort, got %v", err)
+	}
+}
+
+func TestDecodeWrongKey(t *testing.T) {
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf, testCipher(t))
+	enc.Encode(Frame{MsgType: 1, Data: []byte("first")})
+	enc.Encode(Frame{MsgType: 2, Data: []byte("second")})
+
+	dec := NewDecoder(&buf, testCipher(t), 1024)
+
+	_, err := dec.Decode()
+	var decryptErr *DecryptError
+	if !errors.As(err, &decryptErr) {
+		t.Fatalf("expected a DecryptError, got %v", err)
+	}
+
+	// the stream is still in step after a frame fails to decrypt
+	_, err = dec.Decode()
+	if !errors.As(err, &decryptErr) {
+		t.Fatalf("expected a DecryptError for the second frame, got %v", err)
+	}
+
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestHeaders(t *testing.T) {
+
+	headers := map[string]string{"content-type": "application/json", "empty": ""}
+
+	got, err := DecodeHeaders(EncodeHeaders(headers))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != len(headers) || got["content-type"] != "application/json" || got["empty"] != "" {
+		t.Errorf("headers didn't round trip, got %v", got)
+	}
+
+	if _, err := DecodeHeaders([]byte{0, 1, 0, 5, 'a'}); err == nil {
+		t.Error("truncated headers should be rejected")
+	}
+
+	if err := ValidHeaders(map[string]string{"big": strings.Repeat("x", MaxHeadersSize)}); err == nil {
+		t.Error("headers larger than MaxHeadersSize should be rejected")
+	}
+}
+
+func TestChunk(t *testing.T) {
+
+	c := Chunk{Lane: 2, Last: true, MsgType: 42, Data: []byte("part")}
+
+	b := AppendChunk(nil, c)
+	if b[0] != CtrlChunk || len(b) != ChunkHeader+len(c.Data) {
+		t.Fatalf("unexpected chunk encoding %v", b)
+	}
+
+	got, err := ParseChunk(b[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Lane != c.Lane || got.Last != c.Last || got.MsgType != c.MsgType || !bytes.Equal(got.Data, c.Data) {
+		t.Errorf("chunk didn't round trip, got %+v", got)
+	}
+
+	if _, err := ParseChunk(b[1:4]); err == nil {
+		t.Error("a short chunk should be rejected")
+	}
+}
+
+func TestServerHello(t *testing.T) {
+
+	b, _ := ServerHello{Version: Version, Encryption: true}.MarshalBinary()
+	if !bytes.Equal(b, []byte{Version, 1}) {
+		t.Errorf("unexpected server hello %v", b)
+	}
+
+	var h ServerHello
+	if err := h.UnmarshalBinary(b); err != nil || h.Version != Version || !h.Encryption {
+		t.Errorf("server hello didn't round trip, got %+v %v", h, err)
+	}
+
+	if err := h.UnmarshalBinary([]byte{Version}); err == nil {
+		t.Error("a short server hello should be rejected")
+	}
+}
+
+func TestPublicKey(t *testing.T) {
+
+	priv, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := MarshalPublicKey(&priv.PublicKey)
+	if len(b) != PublicKeySize {
+		t.Fatalf("expected %d bytes, got %d", PublicKeySize, len(b))
+	}
+
+	pub, err := UnmarshalPublicKey(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pub.X.Cmp(priv.X) != 0 || pub.Y.Cmp(priv.Y) != 0 {
+		t.Error("public key didn't round trip")
+	}
+
+	if MarshalPublicKey(nil) != nil {
+		t.Error("a nil key should marshal to nil")
+	}
+
+	if _, err := UnmarshalPublicKey(make([]byte, PublicKeySize)); err == nil {
+		t.Error("a point that isn't on the curve should be rejected")
+	}
+}
+
+func TestMaxMsgSize(t *testing.T) {
+
+	for _, g := range []cipher.AEAD{nil, testCipher(t)} {
+
+		b, err := AppendMaxMsgSize(nil, g, 4096)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		size, err := ReadMaxMsgSize(bytes.NewReader(b), g)
+		if err != nil || size != 4096 {
+			t.Errorf("expected 4096, got %d %v", size, err)
+		}
+	}
+
+	b, _ := AppendMaxMsgSize(nil, nil, 512)
+	if _, err := ReadMaxMsgSize(bytes.NewReader(b), nil); err == nil {
+		t.Error("a max message length under 1024 should be rejected")
+	}
+
+	b, _ = AppendMaxMsgSize(nil, nil, MaxMsgSizeCap+1)
+	if _, err := ReadMaxMsgSize(bytes.NewReader(b), nil); err == nil {
+		t.Error("a max message length over the cap should be rejected")
+	}
+
+	if _, err := ReadMaxMsgSize(bytes.NewReader([]byte{0, 0, 1, 0}), nil); err == nil {
+		t.Error("a length prefix over 64 should be rejected")
+	}
+}
+
+// fuzzCipher - a fixed key, so inputs found by the fuzzer can be replayed
+func fuzzCipher(t testing.TB) cipher.AEAD {
+
+	b, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := cipher.NewGCM(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return g
+}
+
+// FuzzDecode - whatever the peer sends, Decode never panics or returns a frame longer than the max message length allows
+func FuzzDecode(f *testing.F) {
+
+	g := fuzzCipher(f)
+
+	for _, c := range []cipher.AEAD{nil, g} {
+
+		b, _ := AppendFrame(nil, c, 5, []byte("hello"))
+		b, _ = AppendFrame(b, c, 0, AppendChunk(nil, Chunk{Lane: 1, Last: true, MsgType: 5, Data: []byte("hi")}))
+		f.Add(b, c != nil)
+	}
+
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff}, false)
+	f.Add([]byte{0, 0, 0, 2, 0, 0}, false)
+	f.Add([]byte{0, 0, 0, 8, 0, 0, 0, 0}, true)
+
+	f.Fuzz(func(t *testing.T, b []byte, encrypted bool) {
+
+		var c cipher.AEAD
+		if encrypted {
+			c = g
+		}
+
+		dec := NewDecoder(bytes.NewReader(b), c, 1024)
+
+		for {
+
+			fr, err := dec.Decode()
+			var decryptErr *DecryptError
+			if errors.As(err, &decryptErr) {
+				continue
+			}
+			if err != nil {
+				return
+			}
+
+			if len(fr.Data) > 1024+FrameOverhead {
+				t.Fatal("frame longer than the max message length decoded", len(fr.Data))
+			}
+		}
+	})
+}
+
+// FuzzReadMaxMsgSize - the max message length sent by the server during the handshake
+func FuzzReadMaxMsgSize(f *testing.F) {
+
+	g := fuzzCipher(f)
+
+	for _, c := range []cipher.AEAD{nil, g} {
+		b, _ := AppendMaxMsgSize(nil, c, 4096)
+		f.Add(b, c != nil)
+	}
+
+	f.Add([]byte{0, 0, 0, 4, 0xff, 0xff, 0xff, 0xff}, false)
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff}, true)
+
+	f.Fuzz(func(t *testing.T, b []byte, encrypted bool) {
+
+		var c cipher.AEAD
+		if encrypted {
+			c = g
+		}
+
+		size, err := ReadMaxMsgSize(bytes.NewReader(b), c)
+		if err == nil && (size < 1024 || size > MaxMsgSizeCap) {
+			t.Fatal("max message length out of range accepted", size)
+		}
+	})
+}
+
+// FuzzServerHello - the first message of the handshake
+func FuzzServerHello(f *testing.F) {
+
+	f.Add([]byte{Version, 1})
+	f.Add([]byte{Version, 7})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+
+		var h ServerHello
+		if h.UnmarshalBinary(b) != nil {
+			return
+		}
+
+		if m, _ := h.MarshalBinary(); m[0] != b[0] || (m[1] != 0) != (b[1] != 0) {
+			t.Fatal("server hello didn't round trip", b, m)
+		}
+	})
+}
+
+// FuzzUnmarshalPublicKey - the public key sent by the other end during the key exchange
+func FuzzUnmarshalPublicKey(f *testing.F) {
+
+	priv, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Add(MarshalPublicKey(&priv.PublicKey))
+	f.Add(make([]byte, PublicKeySize))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+
+		pub, err := UnmarshalPublicKey(b)
+		if err != nil {
+			return
+		}
+
+		if !pub.IsOnCurve(pub.X, pub.Y) || !bytes.Equal(MarshalPublicKey(pub), b) {
+			t.Fatal("public key accepted that isn't on the curve")
+		}
+	})
+}
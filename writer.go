@@ -0,0 +1,145 @@
+package ipc
+
+import (
+	"bufio"
+	"log"
+	"time"
+
+	"github.com/james-barrow/golang-ipc/wire"
+)
+
+// writeLoop - writes queued messages to the session until it ends, a queue is closed or a goodbye has been sent.
+// Messages already waiting in the queues are coalesced into a single flush, up to maxBatch messages, highest priority first.
+// If latency is set the writer also waits up to that long for more messages before flushing.
+func writeLoop(sess *session, l *lanes, maxBatch int, latency time.Duration, metrics Metrics, recorder Recorder) {
+
+	writer := bufio.NewWriter(sess.conn)
+
+	for {
+
+		m, ok := l.wait(sess.done, nil)
+		if !ok || m == nil {
+			return
+		}
+
+		var sent []*Message
+		var timer *time.Timer
+		var timeout <-chan time.Time
+
+		if latency > 0 {
+			timer = time.NewTimer(latency)
+			timeout = timer.C
+		}
+
+		for m != nil {
+
+			buf := getBuffer(0)
+
+			toSend, complete, err := l.encode(sess, (*buf)[:0], m)
+			if err != nil {
+				metrics.EncryptionError()
+				log.Println("error encrypting data", err)
+			} else if len(m.Files) > 0 {
+				// the files go with the first byte of the frames, so anything already buffered has to be written first
+				writer.Flush()
+				err = sess.sendFiles(toSend, m.Files)
+				closeFiles(m.Files)
+				if err != nil {
+					log.Println("error sending files", err)
+				} else {
+					sent = append(sent, m)
+				}
+				*buf = toSend
+			} else {
+				// bufio copies the frame, or writes it straight to the connection, so the buffer can go back to the pool
+				writer.Write(toSend)
+				if complete {
+					sent = append(sent, m.messages()...)
+				}
+				*buf = toSend
+			}
+
+			putBuffer(buf)
+
+			if isGoodbye(m) {
+				// everything queued before the goodbye has been sent, closing the connection ends the read goroutine
+				writer.Flush()
+				sess.conn.Close()
+				return
+			}
+
+			if len(sent) >= maxBatch {
+				break
+			}
+
+			m, ok = l.next()
+			if !ok {
+				break
+			}
+
+			if m == nil && timeout != nil {
+				m, ok = l.wait(sess.done, timeout)
+				if !ok {
+					break
+				}
+			}
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		err := writer.Flush()
+		if err != nil {
+			log.Println("error flushing data", err)
+			continue
+		}
+
+		for _, m := range sent {
+			metrics.MessageSent(m.MsgType, len(m.Data))
+			if recorder != nil {
+				recorder.RecordSent(m)
+			}
+		}
+	}
+}
+
+// encode - appends the frames for the message, or for each message in a batch, to dst ready to be written
+func (sess *session) encode(dst []byte, m *Message) ([]byte, error) {
+
+	var err error
+
+	for _, mm := range m.messages() {
+
+		if len(mm.Files) > 0 {
+			dst, err = wire.AppendFrame(dst, sess.cipher, 0, []byte{ctrlFiles, byte(len(mm.Files))})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if headers := mm.frameHeaders(); headers != nil && sess.caps()&capHeaders != 0 {
+			dst, err = appendHeadersFrame(dst, sess.cipher, headers)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		dst, err = wire.AppendFrame(dst, sess.cipher, mm.MsgType, mm.Data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return dst, nil
+}
+
+// messages - the messages in a batch queued by WriteBatch(), or just m if it isn't a batch
+func (m *Message) messages() []*Message {
+
+	if m.batch != nil {
+		return m.batch
+	}
+
+	return []*Message{m}
+}